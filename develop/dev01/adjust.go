@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+var ErrAdjustUnsupported = errors.New("Adjusting the clock is not supported on this platform")
+
+type SamplesDisagreeError struct {
+	Spread    time.Duration
+	MaxSpread time.Duration
+}
+
+func (err SamplesDisagreeError) Error() string {
+	return fmt.Sprintf("The samples disagree by %s, more than the allowed %s", err.Spread, err.MaxSpread)
+}
+
+type StepTooLargeError struct {
+	Offset  time.Duration
+	MaxStep time.Duration
+}
+
+func (err StepTooLargeError) Error() string {
+	return fmt.Sprintf("The offset %s exceeds the maximum step %s", err.Offset, err.MaxStep)
+}
+
+type AdjustOptions struct {
+	samples        int
+	sampleInterval time.Duration
+	// Наибольшая допустимая разница между измерениями
+	maxSpread time.Duration
+	// Нулевой предел не проверяется
+	maxStep time.Duration
+	// Смещения меньше порога устраняются плавно (slew), остальные - скачком (step)
+	slewThreshold time.Duration
+	dryRun        bool
+}
+
+type Adjustment struct {
+	Offset  time.Duration
+	Spread  time.Duration
+	Samples []time.Duration
+	Step    bool
+}
+
+// Собирает options.samples измерений смещения с паузой sampleInterval между ними.
+// Любая ошибка прерывает измерение: подводить часы по неполным данным нельзя
+func MeasureSamples(options AdjustOptions, measure func() (time.Duration, error)) ([]time.Duration, error) {
+	samples := make([]time.Duration, 0, options.samples)
+	for i := 0; i < max(options.samples, 1); i++ {
+		if i != 0 {
+			time.Sleep(options.sampleInterval)
+		}
+		offset, err := measure()
+		if err != nil {
+			return samples, err
+		}
+		samples = append(samples, offset)
+	}
+	return samples, nil
+}
+
+// Медиана измерений устойчива к одиночному выбросу, но если измерения разошлись
+// сильнее maxSpread или смещение больше maxStep, подводить часы отказываемся
+func PlanAdjustment(samples []time.Duration, options AdjustOptions) (Adjustment, error) {
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + median) / 2
+	}
+
+	adj := Adjustment{
+		Offset:  median,
+		Spread:  sorted[len(sorted)-1] - sorted[0],
+		Samples: samples,
+		Step:    median.Abs() >= options.slewThreshold,
+	}
+	if adj.Spread > options.maxSpread {
+		return adj, SamplesDisagreeError{Spread: adj.Spread, MaxSpread: options.maxSpread}
+	}
+	if options.maxStep != 0 && median.Abs() > options.maxStep {
+		return adj, StepTooLargeError{Offset: median, MaxStep: options.maxStep}
+	}
+	return adj, nil
+}
+
+// Команда, выполняющая ту же подстройку внешними средствами: timedatectl для скачка
+// (время - на момент измерения now) и adjtimex(8) для плавной подстройки
+func (adj Adjustment) Command(now time.Time) string {
+	if adj.Step {
+		return fmt.Sprintf("timedatectl set-time '%s'", now.Add(adj.Offset).Format("2006-01-02 15:04:05.000000"))
+	}
+	return fmt.Sprintf("adjtimex --singleshot %d", adj.Offset.Microseconds())
+}
+
+func (adj Adjustment) Method() string {
+	if adj.Step {
+		return "step"
+	}
+	return "slew"
+}
+
+func WriteAdjustment(w io.Writer, adj Adjustment, dryRun bool, now time.Time) {
+	fmt.Fprintf(w, "Offset: %s (median of %d samples, spread %s)\n", adj.Offset, len(adj.Samples), adj.Spread)
+	if dryRun {
+		fmt.Fprintf(w, "Would %s the clock by %s\n", adj.Method(), adj.Offset)
+		fmt.Fprintln(w, "Command:", adj.Command(now))
+	} else {
+		fmt.Fprintf(w, "Applied a %s of %s\n", adj.Method(), adj.Offset)
+	}
+}
+
+// Подстраивает системные часы, нужны права root (CAP_SYS_TIME)
+func ApplyAdjustment(adj Adjustment) error {
+	if adj.Step {
+		return stepClock(adj.Offset)
+	}
+	return slewClock(adj.Offset)
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Поля Timex 32-битные на 32-битных архитектурах и 64-битные на остальных
+func setField[T int32 | int64](field *T, value int64) {
+	*field = T(value)
+}
+
+func adjtimex(tx *unix.Timex) error {
+	_, err := unix.Adjtimex(tx)
+	if errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("Not permitted to adjust the clock, run as root or with CAP_SYS_TIME: %w", err)
+	}
+	return err
+}
+
+// ADJ_SETOFFSET сдвигает часы атомарно относительно их текущего значения,
+// с ADJ_NANO поле Usec содержит наносекунды
+func stepClock(offset time.Duration) error {
+	sec, nsec := int64(offset/time.Second), int64(offset%time.Second)
+	if nsec < 0 {
+		sec--
+		nsec += int64(time.Second)
+	}
+	tx := unix.Timex{Modes: unix.ADJ_SETOFFSET | unix.ADJ_NANO}
+	setField(&tx.Time.Sec, sec)
+	setField(&tx.Time.Usec, nsec)
+	return adjtimex(&tx)
+}
+
+// Как adjtime(3): ядро плавно устраняет смещение, подстраивая частоту на 500ppm
+func slewClock(offset time.Duration) error {
+	tx := unix.Timex{Modes: unix.ADJ_OFFSET_SINGLESHOT}
+	setField(&tx.Offset, offset.Microseconds())
+	return adjtimex(&tx)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+func stepClock(offset time.Duration) error {
+	return ErrAdjustUnsupported
+}
+
+func slewClock(offset time.Duration) error {
+	return ErrAdjustUnsupported
+}
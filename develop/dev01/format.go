@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type UnknownLayoutError struct {
+	Layout string
+}
+
+func (err UnknownLayoutError) Error() string {
+	return fmt.Sprintf("Unknown time layout %q, expected rfc3339, rfc3339nano, unix, unixmilli, go:<layout> or strftime:<pattern>", err.Layout)
+}
+
+type StrftimeError struct {
+	Directive string
+}
+
+func (err StrftimeError) Error() string {
+	return fmt.Sprintf("Unsupported strftime directive %q", err.Directive)
+}
+
+type TimeFormatter func(time.Time) string
+
+// Пустой layout - формат time.Time.String() без показаний монотонных часов
+func ParseLayout(layout string) (TimeFormatter, error) {
+	switch {
+	case layout == "":
+		return func(t time.Time) string { return t.Round(0).String() }, nil
+	case layout == "rfc3339":
+		return func(t time.Time) string { return t.Format(time.RFC3339) }, nil
+	case layout == "rfc3339nano":
+		return func(t time.Time) string { return t.Format(time.RFC3339Nano) }, nil
+	case layout == "unix":
+		return func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }, nil
+	case layout == "unixmilli":
+		return func(t time.Time) string { return strconv.FormatInt(t.UnixMilli(), 10) }, nil
+	case strings.HasPrefix(layout, "go:"):
+		goLayout := strings.TrimPrefix(layout, "go:")
+		return func(t time.Time) string { return t.Format(goLayout) }, nil
+	case strings.HasPrefix(layout, "strftime:"):
+		pattern := strings.TrimPrefix(layout, "strftime:")
+		// Проверяем шаблон заранее, чтобы ошибка была при разборе флагов, а не при выводе
+		if _, err := Strftime(time.Time{}, pattern); err != nil {
+			return nil, err
+		}
+		return func(t time.Time) string {
+			s, _ := Strftime(t, pattern)
+			return s
+		}, nil
+	}
+	return nil, UnknownLayoutError{layout}
+}
+
+var strftimeDirectives = map[byte]func(time.Time) string{
+	'a': func(t time.Time) string { return t.Format("Mon") },
+	'A': func(t time.Time) string { return t.Format("Monday") },
+	'b': func(t time.Time) string { return t.Format("Jan") },
+	'B': func(t time.Time) string { return t.Format("January") },
+	'c': func(t time.Time) string { return t.Format("Mon Jan _2 15:04:05 2006") },
+	'd': func(t time.Time) string { return t.Format("02") },
+	'e': func(t time.Time) string { return t.Format("_2") },
+	'F': func(t time.Time) string { return t.Format("2006-01-02") },
+	'H': func(t time.Time) string { return t.Format("15") },
+	'I': func(t time.Time) string { return t.Format("03") },
+	'j': func(t time.Time) string { return fmt.Sprintf("%03d", t.YearDay()) },
+	'm': func(t time.Time) string { return t.Format("01") },
+	'M': func(t time.Time) string { return t.Format("04") },
+	'N': func(t time.Time) string { return fmt.Sprintf("%09d", t.Nanosecond()) },
+	'p': func(t time.Time) string { return t.Format("PM") },
+	's': func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	'S': func(t time.Time) string { return t.Format("05") },
+	'T': func(t time.Time) string { return t.Format("15:04:05") },
+	'y': func(t time.Time) string { return t.Format("06") },
+	'Y': func(t time.Time) string { return t.Format("2006") },
+	'z': func(t time.Time) string { return t.Format("-0700") },
+	'Z': func(t time.Time) string { return t.Format("MST") },
+	'%': func(time.Time) string { return "%" },
+}
+
+// Подмножество директив strftime(3) и GNU date (%N - наносекунды)
+func Strftime(t time.Time, pattern string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			b.WriteByte(pattern[i])
+			continue
+		}
+		if i == len(pattern)-1 {
+			return "", StrftimeError{"%"}
+		}
+		i++
+		directive, ok := strftimeDirectives[pattern[i]]
+		if !ok {
+			return "", StrftimeError{"%" + string(pattern[i])}
+		}
+		b.WriteString(directive(t))
+	}
+	return b.String(), nil
+}
+
+func ParseZones(list string) ([]*time.Location, error) {
+	zones := []*time.Location{}
+	if list == "" {
+		return zones, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		zone, err := time.LoadLocation(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// Печатает время, исправленное на offset, во всех запрошенных зонах.
+// В режиме corrected рядом печатаются системное время и разница между ними
+func WriteTime(w io.Writer, output OutputOptions, offset time.Duration) {
+	now := time.Now()
+	corrected := now.Add(offset)
+	if output.corrected {
+		fmt.Fprintln(w, "System clock:   ", output.layout(now))
+		fmt.Fprintln(w, "Corrected time: ", output.layout(corrected))
+		fmt.Fprintln(w, "Difference:     ", offset)
+	} else {
+		fmt.Fprintln(w, "The current time is: ", output.layout(corrected))
+	}
+
+	for _, zone := range output.zones {
+		fmt.Fprintf(w, "%s: %s\n", zone, output.layout(corrected.In(zone)))
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/ntp"
+)
+
+// Симметричные ключи NTP (RFC 5905, 7.3) в формате файла ntp.keys:
+//
+//	# keyid type key
+//	1 MD5 secret
+//	2 SHA1 8d7a2c6ef1e2a3b4c5d6e7f8091a2b3c4d5e6f70
+//
+// Ключ длиной до 20 символов записывается как ASCII, длиннее - как hex
+
+type KeysFileError struct {
+	Line   int
+	Reason string
+}
+
+func (err KeysFileError) Error() string {
+	return fmt.Sprintf("Keys file, line %d: %s", err.Line, err.Reason)
+}
+
+type UnknownKeyError struct {
+	ID uint16
+}
+
+func (err UnknownKeyError) Error() string {
+	return fmt.Sprintf("Key %d is not in the keys file", err.ID)
+}
+
+type SymmetricAuthError struct {
+	Server string
+	KeyID  uint16
+}
+
+func (err SymmetricAuthError) Error() string {
+	return fmt.Sprintf("The MAC of the response from %s doesn't verify with the key %d", err.Server, err.KeyID)
+}
+
+func (err SymmetricAuthError) Unwrap() error {
+	return ntp.ErrAuthFailed
+}
+
+var authTypes = map[string]ntp.AuthType{
+	"M":          ntp.AuthMD5,
+	"MD5":        ntp.AuthMD5,
+	"SHA1":       ntp.AuthSHA1,
+	"SHA256":     ntp.AuthSHA256,
+	"SHA512":     ntp.AuthSHA512,
+	"AES128CMAC": ntp.AuthAES128,
+	"AES256CMAC": ntp.AuthAES256,
+}
+
+// Размер дайджеста (для SHA256 и SHA512 он усекается до 20 байт, как в ntpd) и требования к длине ключа
+var digestSizes = map[ntp.AuthType]struct{ digest, minKey, maxKey int }{
+	ntp.AuthMD5:    {16, 4, 32},
+	ntp.AuthSHA1:   {20, 4, 32},
+	ntp.AuthSHA256: {20, 4, 32},
+	ntp.AuthSHA512: {20, 4, 32},
+	ntp.AuthAES128: {16, 16, 16},
+	ntp.AuthAES256: {16, 32, 32},
+}
+
+type SymmetricKey struct {
+	ID     uint16
+	Type   ntp.AuthType
+	Secret []byte
+}
+
+type KeyRing map[uint16]SymmetricKey
+
+func (k SymmetricKey) AuthOptions() ntp.AuthOptions {
+	return ntp.AuthOptions{Type: k.Type, Key: "HEX:" + hex.EncodeToString(k.Secret), KeyID: k.ID}
+}
+
+func (k SymmetricKey) Digest(payload []byte) []byte {
+	data := append(append([]byte{}, k.Secret...), payload...)
+	switch k.Type {
+	case ntp.AuthMD5:
+		digest := md5.Sum(data)
+		return digest[:]
+	case ntp.AuthSHA1:
+		digest := sha1.Sum(data)
+		return digest[:]
+	case ntp.AuthSHA256:
+		digest := sha256.Sum256(data)
+		return digest[:20]
+	case ntp.AuthSHA512:
+		digest := sha512.Sum512(data)
+		return digest[:20]
+	}
+
+	block, err := aes.NewCipher(k.Secret)
+	if err != nil {
+		// Длина ключа проверяется при разборе файла
+		panic(err)
+	}
+	return cmac(block, payload)
+}
+
+func ParseKeys(r io.Reader) (KeyRing, error) {
+	keys := KeyRing{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		// После ключа ntpd допускает список адресов, которым он разрешён, здесь он игнорируется
+		if len(fields) < 3 {
+			return nil, KeysFileError{line, "expected \"keyid type key\""}
+		}
+
+		id, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil || id == 0 {
+			return nil, KeysFileError{line, fmt.Sprintf("bad key id %q", fields[0])}
+		}
+		authType, ok := authTypes[strings.ToUpper(fields[1])]
+		if !ok {
+			return nil, KeysFileError{line, fmt.Sprintf("unsupported key type %q", fields[1])}
+		}
+
+		secret := []byte(fields[2])
+		if len(fields[2]) > 20 {
+			if secret, err = hex.DecodeString(fields[2]); err != nil {
+				return nil, KeysFileError{line, "keys longer than 20 characters must be hex-encoded"}
+			}
+		}
+		sizes := digestSizes[authType]
+		if len(secret) < sizes.minKey || len(secret) > sizes.maxKey {
+			return nil, KeysFileError{line, fmt.Sprintf("%s key must be %d to %d bytes long", fields[1], sizes.minKey, sizes.maxKey)}
+		}
+
+		if _, ok := keys[uint16(id)]; ok {
+			return nil, KeysFileError{line, fmt.Sprintf("duplicate key id %d", id)}
+		}
+		keys[uint16(id)] = SymmetricKey{ID: uint16(id), Type: authType, Secret: secret}
+	}
+	return keys, scanner.Err()
+}
+
+func LoadKeys(path string) (KeyRing, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseKeys(file)
+}
+
+// Ключ по умолчанию и ключи отдельных серверов, задаются как "5" или "5,host=7,host2=8"
+type KeyIDs struct {
+	Default   uint16
+	PerServer map[string]uint16
+}
+
+func ParseKeyIDs(spec string) (KeyIDs, error) {
+	ids := KeyIDs{PerServer: map[string]uint16{}}
+	if spec == "" {
+		return ids, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		server, idStr, perServer := strings.Cut(part, "=")
+		if !perServer {
+			idStr = server
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 16)
+		if err != nil || id == 0 {
+			return ids, fmt.Errorf("Bad key id %q", idStr)
+		}
+
+		if perServer {
+			ids.PerServer[strings.TrimSpace(server)] = uint16(id)
+		} else {
+			ids.Default = uint16(id)
+		}
+	}
+	return ids, nil
+}
+
+func (ids KeyIDs) Check(keys KeyRing) error {
+	if _, ok := keys[ids.Default]; ids.Default != 0 && !ok {
+		return UnknownKeyError{ids.Default}
+	}
+	for _, id := range ids.PerServer {
+		if _, ok := keys[id]; !ok {
+			return UnknownKeyError{id}
+		}
+	}
+	return nil
+}
+
+func (ids KeyIDs) For(server string) uint16 {
+	if id, ok := ids.PerServer[server]; ok {
+		return id
+	}
+	return ids.Default
+}
+
+// Подписывает запросы ключом сервера и отбрасывает ответы, MAC которых не сходится.
+// Серверы без назначенного ключа опрашиваются без аутентификации
+func AuthenticatedQuery(keys KeyRing, ids KeyIDs, base ntp.QueryOptions) QueryFunc {
+	return func(server string) (*ntp.Response, error) {
+		opt := base
+		id := ids.For(server)
+		if id != 0 {
+			key, ok := keys[id]
+			if !ok {
+				return nil, UnknownKeyError{id}
+			}
+			opt.Auth = key.AuthOptions()
+		}
+
+		resp, err := ntp.QueryWithOptions(server, opt)
+		if err != nil {
+			return nil, err
+		}
+		if err := resp.Validate(); errors.Is(err, ntp.ErrAuthFailed) {
+			return nil, SymmetricAuthError{Server: server, KeyID: id}
+		}
+		return resp, nil
+	}
+}
+
+// Серверная часть: проверяет MAC запроса и подписывает ответ тем же ключом.
+// Если ключ неизвестен или MAC не сходится, отвечает crypto-NAK (MAC из одного нулевого key id)
+type SymmetricKeyExtension struct {
+	Keys KeyRing
+}
+
+func (e SymmetricKeyExtension) ProcessReply(req []byte, reply *bytes.Buffer) error {
+	if len(req) == headerSize {
+		return nil
+	}
+	if len(req) < headerSize+4 {
+		return BadRequestError{"truncated MAC"}
+	}
+
+	id := binary.BigEndian.Uint32(req[headerSize:])
+	key, ok := e.Keys[uint16(id)]
+	if !ok || id > 0xffff || len(req) != headerSize+4+digestSizes[key.Type].digest ||
+		subtle.ConstantTimeCompare(key.Digest(req[:headerSize]), req[headerSize+4:]) != 1 {
+		reply.Write(make([]byte, 4))
+		return nil
+	}
+
+	digest := key.Digest(reply.Bytes())
+	binary.Write(reply, binary.BigEndian, id)
+	reply.Write(digest)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type serverMetrics struct {
+	offset      time.Duration
+	rtt         time.Duration
+	stratum     uint8
+	lastSuccess time.Time
+	up          bool
+	errors      int
+}
+
+// Экспортер метрик в текстовом формате Prometheus, значения обновляются опросом серверов по расписанию
+type Exporter struct {
+	servers []string
+	query   QueryFunc
+
+	mu      sync.RWMutex
+	metrics map[string]*serverMetrics
+}
+
+func NewExporter(servers []string, query QueryFunc) *Exporter {
+	metrics := map[string]*serverMetrics{}
+	for _, server := range servers {
+		metrics[server] = &serverMetrics{}
+	}
+	return &Exporter{servers: servers, query: query, metrics: metrics}
+}
+
+func (e *Exporter) Refresh() []ServerResult {
+	results := QueryServers(e.servers, e.query)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, res := range results {
+		m := e.metrics[res.Server]
+		if res.Err != nil {
+			m.up = false
+			m.errors++
+			continue
+		}
+		m.up = true
+		m.offset = res.Response.ClockOffset
+		m.rtt = res.Response.RTT
+		m.stratum = res.Response.Stratum
+		m.lastSuccess = time.Now()
+	}
+	return results
+}
+
+// Обновляет метрики раз в interval, пока не закрыт stop
+func (e *Exporter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			e.Refresh()
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricFamily struct {
+	name  string
+	help  string
+	typ   string
+	value func(m *serverMetrics) (float64, bool)
+}
+
+var metricFamilies = []metricFamily{
+	{"ntp_up", "Whether the last query of the server succeeded.", "gauge", func(m *serverMetrics) (float64, bool) {
+		if m.up {
+			return 1, true
+		}
+		return 0, true
+	}},
+	{"ntp_offset_seconds", "Clock offset of the local system relative to the server.", "gauge", func(m *serverMetrics) (float64, bool) {
+		return m.offset.Seconds(), !m.lastSuccess.IsZero()
+	}},
+	{"ntp_rtt_seconds", "Round-trip delay to the server.", "gauge", func(m *serverMetrics) (float64, bool) {
+		return m.rtt.Seconds(), !m.lastSuccess.IsZero()
+	}},
+	{"ntp_stratum", "Stratum reported by the server.", "gauge", func(m *serverMetrics) (float64, bool) {
+		return float64(m.stratum), !m.lastSuccess.IsZero()
+	}},
+	{"ntp_last_success_timestamp_seconds", "Unix time of the last successful query.", "gauge", func(m *serverMetrics) (float64, bool) {
+		return float64(m.lastSuccess.UnixNano()) / 1e9, !m.lastSuccess.IsZero()
+	}},
+	{"ntp_query_errors_total", "Number of failed queries.", "counter", func(m *serverMetrics) (float64, bool) {
+		return float64(m.errors), true
+	}},
+}
+
+func (e *Exporter) WriteMetrics(w io.Writer) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, family := range metricFamilies {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.typ)
+		for _, server := range e.servers {
+			if value, ok := family.value(e.metrics[server]); ok {
+				fmt.Fprintf(w, "%s{server=\"%s\"} %g\n", family.name, labelEscaper.Replace(server), value)
+			}
+		}
+	}
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.WriteMetrics(w)
+}
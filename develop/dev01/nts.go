@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+// Network Time Security (RFC 8915): ключи и cookies выдаются по TLS (NTS-KE),
+// после чего каждый NTPv4 запрос и ответ аутентифицируются полями расширения
+
+const (
+	ntsKEPort    = "4460"
+	ntsALPN      = "ntske/1"
+	ntsExporter  = "EXPORTER-network-time-security"
+	ntsMaxCookie = 8
+
+	ntsProtocolNTPv4 = 0
+	ntsAEADSIV256    = 15
+
+	keCritical       = 0x8000
+	keEndOfMessage   = 0
+	keNextProtocol   = 1
+	keError          = 2
+	keWarning        = 3
+	keAEADAlgorithm  = 4
+	keNewCookie      = 5
+	keNTPv4Server    = 6
+	keNTPv4Port      = 7
+	keMaxRecordCount = 256
+
+	extUniqueIdentifier  = 0x0104
+	extCookie            = 0x0204
+	extCookiePlaceholder = 0x0304
+	extAuthenticator     = 0x0404
+
+	ntsUIDSize   = 32
+	ntsNonceSize = 16
+)
+
+var (
+	ErrNTSAuthFailed = errors.New("NTS authentication of the response failed")
+	ErrNTSNak        = errors.New("The server couldn't authenticate the NTS request (NTSN kiss code)")
+	ErrNTSNoCookies  = errors.New("No NTS cookies left, a new key exchange is required")
+)
+
+type NTSKeyExchangeError struct {
+	Reason string
+}
+
+func (err NTSKeyExchangeError) Error() string {
+	return fmt.Sprintf("NTS key exchange failed: %s", err.Reason)
+}
+
+type ntsKERecord struct {
+	critical bool
+	typ      uint16
+	body     []byte
+}
+
+func writeKERecord(w io.Writer, record ntsKERecord) error {
+	header := make([]byte, 4)
+	typ := record.typ
+	if record.critical {
+		typ |= keCritical
+	}
+	binary.BigEndian.PutUint16(header[:2], typ)
+	binary.BigEndian.PutUint16(header[2:], uint16(len(record.body)))
+	_, err := w.Write(append(header, record.body...))
+	return err
+}
+
+func readKERecord(r io.Reader) (ntsKERecord, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return ntsKERecord{}, err
+	}
+	typ := binary.BigEndian.Uint16(header[:2])
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return ntsKERecord{}, err
+	}
+	return ntsKERecord{critical: typ&keCritical != 0, typ: typ &^ keCritical, body: body}, nil
+}
+
+func uint16Body(values ...uint16) []byte {
+	body := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(body[2*i:], v)
+	}
+	return body
+}
+
+func containsUint16(body []byte, value uint16) bool {
+	for i := 0; i+1 < len(body); i += 2 {
+		if binary.BigEndian.Uint16(body[i:]) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Ключи направления выводятся из TLS сессии, контекст - протокол, AEAD алгоритм и направление (RFC 8915, 5.1)
+func exportNTSKeys(state tls.ConnectionState) (c2s, s2c *SIV, err error) {
+	context := append(uint16Body(ntsProtocolNTPv4, ntsAEADSIV256), 0)
+	c2sKey, err := state.ExportKeyingMaterial(ntsExporter, context, sivKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	context[len(context)-1] = 1
+	s2cKey, err := state.ExportKeyingMaterial(ntsExporter, context, sivKeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c2s, err = NewSIV(c2sKey); err != nil {
+		return nil, nil, err
+	}
+	if s2c, err = NewSIV(s2cKey); err != nil {
+		return nil, nil, err
+	}
+	return c2s, s2c, nil
+}
+
+type NTSSession struct {
+	// Адрес NTP сервера, который может отличаться от адреса NTS-KE сервера
+	Server string
+
+	c2s *SIV
+	s2c *SIV
+
+	mu      sync.Mutex
+	cookies [][]byte
+}
+
+func (s *NTSSession) popCookie() ([]byte, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.cookies) == 0 {
+		return nil, 0
+	}
+	cookie := s.cookies[0]
+	s.cookies = s.cookies[1:]
+	return cookie, len(s.cookies)
+}
+
+func (s *NTSSession) addCookies(cookies [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cookies = append(s.cookies, cookies...)
+	if len(s.cookies) > ntsMaxCookie {
+		s.cookies = s.cookies[len(s.cookies)-ntsMaxCookie:]
+	}
+}
+
+func (s *NTSSession) Cookies() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.cookies)
+}
+
+// Выполняет NTS-KE с сервером address ("host" или "host:port", порт по умолчанию 4460)
+func NTSKeyExchange(address string, config *tls.Config, timeout time.Duration) (*NTSSession, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ntsKEPort
+	}
+
+	config = config.Clone()
+	config.NextProtos = []string{ntsALPN}
+	config.MinVersion = tls.VersionTLS13
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var request bytes.Buffer
+	writeKERecord(&request, ntsKERecord{critical: true, typ: keNextProtocol, body: uint16Body(ntsProtocolNTPv4)})
+	writeKERecord(&request, ntsKERecord{typ: keAEADAlgorithm, body: uint16Body(ntsAEADSIV256)})
+	writeKERecord(&request, ntsKERecord{critical: true, typ: keEndOfMessage})
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		return nil, err
+	}
+
+	session := &NTSSession{}
+	ntpHost, ntpPort := host, "123"
+	protocolAccepted, aeadAccepted := false, false
+	for i := 0; ; i++ {
+		if i == keMaxRecordCount {
+			return nil, NTSKeyExchangeError{"too many records in the response"}
+		}
+		record, err := readKERecord(conn)
+		if err != nil {
+			return nil, NTSKeyExchangeError{fmt.Sprintf("error while reading the response: %s", err)}
+		}
+
+		switch record.typ {
+		case keEndOfMessage:
+		case keNextProtocol:
+			protocolAccepted = containsUint16(record.body, ntsProtocolNTPv4)
+		case keAEADAlgorithm:
+			aeadAccepted = containsUint16(record.body, ntsAEADSIV256)
+		case keError:
+			return nil, NTSKeyExchangeError{fmt.Sprintf("the server returned an error %v", record.body)}
+		case keNewCookie:
+			session.cookies = append(session.cookies, record.body)
+		case keNTPv4Server:
+			ntpHost = string(record.body)
+		case keNTPv4Port:
+			if len(record.body) != 2 {
+				return nil, NTSKeyExchangeError{"malformed port record"}
+			}
+			ntpPort = strconv.Itoa(int(binary.BigEndian.Uint16(record.body)))
+		case keWarning:
+		default:
+			if record.critical {
+				return nil, NTSKeyExchangeError{fmt.Sprintf("unsupported critical record %d", record.typ)}
+			}
+		}
+		if record.typ == keEndOfMessage {
+			break
+		}
+	}
+
+	switch {
+	case !protocolAccepted:
+		return nil, NTSKeyExchangeError{"the server doesn't support NTPv4"}
+	case !aeadAccepted:
+		return nil, NTSKeyExchangeError{"the server doesn't support AEAD_AES_SIV_CMAC_256"}
+	case len(session.cookies) == 0:
+		return nil, NTSKeyExchangeError{"the server didn't send any cookies"}
+	}
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != ntsALPN {
+		return nil, NTSKeyExchangeError{"the server didn't negotiate " + ntsALPN}
+	}
+	session.c2s, session.s2c, err = exportNTSKeys(state)
+	if err != nil {
+		return nil, NTSKeyExchangeError{err.Error()}
+	}
+	session.Server = net.JoinHostPort(ntpHost, ntpPort)
+	return session, nil
+}
+
+type extensionField struct {
+	typ  uint16
+	body []byte
+	// Смещение начала поля в пакете
+	start int
+}
+
+func appendExtensionField(buf *bytes.Buffer, typ uint16, body []byte) {
+	padded := (len(body) + 3) &^ 3
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint16(header[:2], typ)
+	binary.BigEndian.PutUint16(header[2:], uint16(4+padded))
+	buf.Write(header)
+	buf.Write(body)
+	buf.Write(make([]byte, padded-len(body)))
+}
+
+func parseExtensionFields(packet []byte, start int) ([]extensionField, error) {
+	fields := []extensionField{}
+	for offset := start; offset < len(packet); {
+		if offset+4 > len(packet) {
+			return nil, ErrNTSAuthFailed
+		}
+		length := int(binary.BigEndian.Uint16(packet[offset+2:]))
+		if length < 4 || length%4 != 0 || offset+length > len(packet) {
+			return nil, ErrNTSAuthFailed
+		}
+		fields = append(fields, extensionField{
+			typ:   binary.BigEndian.Uint16(packet[offset:]),
+			body:  packet[offset+4 : offset+length],
+			start: offset,
+		})
+		offset += length
+	}
+	return fields, nil
+}
+
+func appendAuthenticator(buf *bytes.Buffer, aead *SIV, plaintext []byte) error {
+	nonce := make([]byte, ntsNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	ciphertext := aead.Seal(nonce, plaintext, buf.Bytes())
+
+	body := uint16Body(uint16(len(nonce)), uint16(len(ciphertext)))
+	body = append(body, nonce...)
+	body = append(body, ciphertext...)
+	appendExtensionField(buf, extAuthenticator, body)
+	return nil
+}
+
+// Проверяет последнее поле-аутентификатор и возвращает расшифрованные поля расширения
+func openAuthenticator(packet []byte, fields []extensionField, aead *SIV) ([]byte, error) {
+	if len(fields) == 0 || fields[len(fields)-1].typ != extAuthenticator {
+		return nil, ErrNTSAuthFailed
+	}
+	auth := fields[len(fields)-1]
+	if len(auth.body) < 4 {
+		return nil, ErrNTSAuthFailed
+	}
+	nonceLen := int(binary.BigEndian.Uint16(auth.body[:2]))
+	ciphertextLen := int(binary.BigEndian.Uint16(auth.body[2:4]))
+	nonceEnd := 4 + (nonceLen+3)&^3
+	if nonceEnd+ciphertextLen > len(auth.body) {
+		return nil, ErrNTSAuthFailed
+	}
+
+	plaintext, err := aead.Open(auth.body[4:4+nonceLen], auth.body[nonceEnd:nonceEnd+ciphertextLen], packet[:auth.start])
+	if err != nil {
+		return nil, ErrNTSAuthFailed
+	}
+	return plaintext, nil
+}
+
+// Расширение для одного запроса к серверу: добавляет уникальный идентификатор, cookie и аутентификатор,
+// а в ответе проверяет их и забирает новые cookies
+type ntsExtension struct {
+	session *NTSSession
+	uid     []byte
+}
+
+func (e *ntsExtension) ProcessQuery(buf *bytes.Buffer) error {
+	cookie, left := e.session.popCookie()
+	if cookie == nil {
+		return ErrNTSNoCookies
+	}
+
+	e.uid = make([]byte, ntsUIDSize)
+	if _, err := rand.Read(e.uid); err != nil {
+		return err
+	}
+	appendExtensionField(buf, extUniqueIdentifier, e.uid)
+	appendExtensionField(buf, extCookie, cookie)
+	// Плейсхолдеры просят сервер вернуть больше cookies, чтобы восполнить запас
+	for range ntsMaxCookie - left - 1 {
+		appendExtensionField(buf, extCookiePlaceholder, make([]byte, len(cookie)))
+	}
+	return appendAuthenticator(buf, e.session.c2s, nil)
+}
+
+func (e *ntsExtension) ProcessResponse(buf []byte) error {
+	if len(buf) < headerSize {
+		return ErrNTSAuthFailed
+	}
+	if buf[1] == 0 && string(buf[12:16]) == "NTSN" {
+		return ErrNTSNak
+	}
+
+	fields, err := parseExtensionFields(buf, headerSize)
+	if err != nil {
+		return err
+	}
+	uidMatched := false
+	for _, field := range fields {
+		if field.typ == extUniqueIdentifier && bytes.Equal(field.body, e.uid) {
+			uidMatched = true
+		}
+	}
+	if !uidMatched {
+		return ErrNTSAuthFailed
+	}
+
+	plaintext, err := openAuthenticator(buf, fields, e.session.s2c)
+	if err != nil {
+		return err
+	}
+	encrypted, err := parseExtensionFields(plaintext, 0)
+	if err != nil {
+		return err
+	}
+	cookies := [][]byte{}
+	for _, field := range encrypted {
+		if field.typ == extCookie {
+			cookies = append(cookies, append([]byte{}, field.body...))
+		}
+	}
+	e.session.addCookies(cookies)
+	return nil
+}
+
+func (s *NTSSession) Query(opt ntp.QueryOptions) (*ntp.Response, error) {
+	opt.Extensions = append(append([]ntp.Extension{}, opt.Extensions...), &ntsExtension{session: s})
+	return ntp.QueryWithOptions(s.Server, opt)
+}
+
+// Хранит по одной NTS сессии на сервер и повторяет обмен ключами, когда cookies заканчиваются
+type NTSClient struct {
+	config  *tls.Config
+	timeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*NTSSession
+}
+
+func NewNTSClient(config *tls.Config, timeout time.Duration) *NTSClient {
+	return &NTSClient{config: config, timeout: timeout, sessions: map[string]*NTSSession{}}
+}
+
+func (c *NTSClient) session(server string) (*NTSSession, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if session, ok := c.sessions[server]; ok && session.Cookies() != 0 {
+		return session, nil
+	}
+
+	session, err := NTSKeyExchange(server, c.config, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.sessions[server] = session
+	return session, nil
+}
+
+func (c *NTSClient) Query(server string) (*ntp.Response, error) {
+	session, err := c.session(server)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := session.Query(ntp.QueryOptions{Timeout: c.timeout})
+	if errors.Is(err, ErrNTSNak) {
+		// Сервер больше не принимает наши cookies, в следующий раз нужен новый обмен ключами
+		c.mu.Lock()
+		delete(c.sessions, server)
+		c.mu.Unlock()
+	}
+	return resp, err
+}
+
+func isAuthError(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	return errors.Is(err, ErrNTSAuthFailed) || errors.Is(err, ErrNTSNak) || errors.Is(err, ntp.ErrAuthFailed) ||
+		errors.As(err, &certErr)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+type UnknownFormatError struct {
+	Format string
+}
+
+func (err UnknownFormatError) Error() string {
+	return fmt.Sprintf("Unknown output format %q, expected %q or %q", err.Format, formatText, formatJSON)
+}
+
+// Ответ сервера получен, но для синхронизации он не годится (kiss-of-death, stratum 0, leap unsynchronized, ...)
+type InvalidResponseError struct {
+	Err error
+}
+
+func (err InvalidResponseError) Error() string {
+	return fmt.Sprintf("The response is unusable: %s", err.Err)
+}
+
+func (err InvalidResponseError) Unwrap() error {
+	return err.Err
+}
+
+var leapNames = map[ntp.LeapIndicator]string{
+	ntp.LeapNoWarning: "no warning",
+	ntp.LeapAddSecond: "last minute has 61 seconds",
+	ntp.LeapDelSecond: "last minute has 59 seconds",
+	ntp.LeapNotInSync: "unsynchronized",
+}
+
+// Длительности в JSON сериализуются в наносекундах
+type Report struct {
+	Server          string        `json:"server"`
+	Time            time.Time     `json:"time"`
+	ClockOffset     time.Duration `json:"clock_offset_ns"`
+	RTT             time.Duration `json:"rtt_ns"`
+	Stratum         uint8         `json:"stratum"`
+	ReferenceID     string        `json:"reference_id"`
+	ReferenceTime   time.Time     `json:"reference_time"`
+	RootDelay       time.Duration `json:"root_delay_ns"`
+	RootDispersion  time.Duration `json:"root_dispersion_ns"`
+	RootDistance    time.Duration `json:"root_distance_ns"`
+	Leap            string        `json:"leap"`
+	Precision       time.Duration `json:"precision_ns"`
+	Version         int           `json:"version"`
+	Poll            time.Duration `json:"poll_ns"`
+	KissCode        string        `json:"kiss_code,omitempty"`
+	Valid           bool          `json:"valid"`
+	ValidationError string        `json:"validation_error,omitempty"`
+	Error           string        `json:"error,omitempty"`
+}
+
+type SelectionReport struct {
+	Time         time.Time     `json:"time"`
+	Offset       time.Duration `json:"offset_ns"`
+	Truechimers  []string      `json:"truechimers"`
+	Falsetickers []string      `json:"falsetickers"`
+	Error        string        `json:"error,omitempty"`
+	Servers      []Report      `json:"servers"`
+}
+
+func NewReport(server string, resp *ntp.Response) Report {
+	report := Report{
+		Server:         server,
+		Time:           time.Now().Add(resp.ClockOffset),
+		ClockOffset:    resp.ClockOffset,
+		RTT:            resp.RTT,
+		Stratum:        resp.Stratum,
+		ReferenceID:    resp.ReferenceString(),
+		ReferenceTime:  resp.ReferenceTime,
+		RootDelay:      resp.RootDelay,
+		RootDispersion: resp.RootDispersion,
+		RootDistance:   resp.RootDistance,
+		Leap:           leapNames[resp.Leap],
+		Precision:      resp.Precision,
+		Version:        resp.Version,
+		Poll:           resp.Poll,
+		KissCode:       resp.KissCode,
+		Valid:          true,
+	}
+
+	if err := resp.Validate(); err != nil {
+		report.Valid = false
+		report.ValidationError = err.Error()
+	}
+	return report
+}
+
+func NewServerReport(res ServerResult) Report {
+	if res.Response == nil {
+		return Report{Server: res.Server, Error: res.Err.Error()}
+	}
+	return NewReport(res.Server, res.Response)
+}
+
+func NewSelectionReport(results []ServerResult, selection Selection, err error) SelectionReport {
+	report := SelectionReport{
+		Time:         time.Now().Add(selection.Offset),
+		Offset:       selection.Offset,
+		Truechimers:  serverList(selection.Truechimers),
+		Falsetickers: serverList(selection.Falsetickers),
+		Servers:      make([]Report, len(results)),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	for i, res := range results {
+		report.Servers[i] = NewServerReport(res)
+	}
+	return report
+}
+
+func serverList(results []ServerResult) []string {
+	names := make([]string, len(results))
+	for i, res := range results {
+		names[i] = res.Server
+	}
+	return names
+}
+
+func WriteJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func WriteReport(w io.Writer, report Report) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "Server:\t%s\n", report.Server)
+	if report.Error != "" {
+		fmt.Fprintf(tw, "Error:\t%s\n", report.Error)
+		return tw.Flush()
+	}
+
+	fmt.Fprintf(tw, "Time:\t%s\n", report.Time)
+	fmt.Fprintf(tw, "Clock offset:\t%s\n", report.ClockOffset)
+	fmt.Fprintf(tw, "Round-trip delay:\t%s\n", report.RTT)
+	fmt.Fprintf(tw, "Stratum:\t%d\n", report.Stratum)
+	fmt.Fprintf(tw, "Reference ID:\t%s\n", report.ReferenceID)
+	fmt.Fprintf(tw, "Reference time:\t%s\n", report.ReferenceTime)
+	fmt.Fprintf(tw, "Root delay:\t%s\n", report.RootDelay)
+	fmt.Fprintf(tw, "Root dispersion:\t%s\n", report.RootDispersion)
+	fmt.Fprintf(tw, "Root distance:\t%s\n", report.RootDistance)
+	fmt.Fprintf(tw, "Leap indicator:\t%s\n", report.Leap)
+	fmt.Fprintf(tw, "Precision:\t%s\n", report.Precision)
+	fmt.Fprintf(tw, "Version:\t%d\n", report.Version)
+	fmt.Fprintf(tw, "Poll:\t%s\n", report.Poll)
+	if report.KissCode != "" {
+		fmt.Fprintf(tw, "Kiss code:\t%s\n", report.KissCode)
+	}
+	if report.Valid {
+		fmt.Fprintf(tw, "Valid:\tyes\n")
+	} else {
+		fmt.Fprintf(tw, "Valid:\tno (%s)\n", report.ValidationError)
+	}
+	return tw.Flush()
+}
+
+func WriteSelectionReport(w io.Writer, report SelectionReport) error {
+	for _, server := range report.Servers {
+		if err := WriteReport(w, server); err != nil {
+			return err
+		}
+		fmt.Fprintln(w)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	if report.Error != "" {
+		fmt.Fprintf(tw, "Selection error:\t%s\n", report.Error)
+		return tw.Flush()
+	}
+	fmt.Fprintf(tw, "Time:\t%s\n", report.Time)
+	fmt.Fprintf(tw, "Combined offset:\t%s\n", report.Offset)
+	fmt.Fprintf(tw, "Agreed servers:\t%v\n", report.Truechimers)
+	fmt.Fprintf(tw, "Discarded falsetickers:\t%v\n", report.Falsetickers)
+	return tw.Flush()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+type Attempt struct {
+	Server string
+	Number int
+	Err    error
+}
+
+type QueryFailedError struct {
+	Attempts []Attempt
+}
+
+func (err QueryFailedError) Error() string {
+	last := err.Attempts[len(err.Attempts)-1]
+	return fmt.Sprintf("All %d attempts failed, the last one to %s: %s", len(err.Attempts), last.Server, last.Err)
+}
+
+// Код выхода определяется последней ошибкой
+func (err QueryFailedError) Unwrap() error {
+	return err.Attempts[len(err.Attempts)-1].Err
+}
+
+type RetryPolicy struct {
+	// Число повторов после первой попытки
+	Retries int
+	// Пауза перед первым повтором, дальше она удваивается
+	Backoff time.Duration
+}
+
+// Повторять имеет смысл только сетевые ошибки: kiss-of-death, невалидный ответ
+// или проваленная аутентификация от повторного запроса к тому же серверу не исправятся
+func retryable(err error) bool {
+	var invalid InvalidResponseError
+	return !errors.As(err, &invalid) && !isAuthError(err)
+}
+
+func (p RetryPolicy) Query(server string, query QueryFunc) (*ntp.Response, []Attempt, error) {
+	attempts := []Attempt{}
+	backoff := p.Backoff
+	for i := 0; ; i++ {
+		resp, err := query(server)
+		if err == nil {
+			return resp, attempts, nil
+		}
+		attempts = append(attempts, Attempt{Server: server, Number: i + 1, Err: err})
+		if i >= p.Retries || !retryable(err) {
+			return resp, attempts, QueryFailedError{attempts}
+		}
+
+		time.Sleep(backoff)
+		if backoff <= math.MaxInt64/2 {
+			backoff *= 2
+		}
+	}
+}
+
+// Query в виде QueryFunc, например для QueryServers. Неудачные попытки пишутся в l,
+// в том числе у серверов, ответивших с повтора
+func (p RetryPolicy) Wrap(l *log.Logger, query QueryFunc) QueryFunc {
+	return func(server string) (*ntp.Response, error) {
+		resp, attempts, err := p.Query(server, query)
+		LogAttempts(l, attempts)
+		return resp, err
+	}
+}
+
+// Опрашивает серверы по порядку, пока один из них не ответит.
+// Если не ответил никто, возвращается последний полученный ответ (например, невалидный) и ошибка
+func QueryWithFallback(servers []string, policy RetryPolicy, query QueryFunc) (string, *ntp.Response, []Attempt, error) {
+	attempts := []Attempt{}
+	var lastResp *ntp.Response
+	var lastServer string
+	for _, server := range servers {
+		resp, serverAttempts, err := policy.Query(server, query)
+		attempts = append(attempts, serverAttempts...)
+		if err == nil {
+			return server, resp, attempts, nil
+		}
+		if resp != nil {
+			lastServer, lastResp = server, resp
+		}
+	}
+	return lastServer, lastResp, attempts, QueryFailedError{attempts}
+}
+
+func LogAttempts(l *log.Logger, attempts []Attempt) {
+	for _, attempt := range attempts {
+		l.Printf("Attempt %d to %s failed: %s\n", attempt.Number, attempt.Server, attempt.Err)
+	}
+}
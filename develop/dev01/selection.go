@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+// Минимальная полуширина интервала корректности (MINDISP/2 из RFC 5905),
+// чтобы серверы с почти нулевой задержкой не превращались в точки
+const minDistance = 5 * time.Millisecond
+
+type NoMajorityError struct {
+	Agreed int
+	Total  int
+}
+
+func (err NoMajorityError) Error() string {
+	return fmt.Sprintf("Only %d of %d servers agree on the time, no majority", err.Agreed, err.Total)
+}
+
+var ErrNoResponses = errors.New("None of the servers responded")
+
+type QueryFunc func(server string) (*ntp.Response, error)
+
+type ServerResult struct {
+	Server   string
+	Response *ntp.Response
+	Err      error
+}
+
+type Selection struct {
+	Offset       time.Duration
+	Low          time.Duration
+	High         time.Duration
+	Truechimers  []ServerResult
+	Falsetickers []ServerResult
+	Failed       []ServerResult
+}
+
+// Ответы, непригодные для синхронизации, считаются ошибкой опроса, но сам ответ сохраняется для диагностики
+func ValidatedQuery(query QueryFunc) QueryFunc {
+	return func(server string) (*ntp.Response, error) {
+		resp, err := query(server)
+		if err != nil {
+			return nil, err
+		}
+		if err := resp.Validate(); err != nil {
+			return resp, InvalidResponseError{err}
+		}
+		return resp, nil
+	}
+}
+
+// Опрашивает все серверы параллельно, порядок результатов совпадает с порядком серверов
+func QueryServers(servers []string, query QueryFunc) []ServerResult {
+	results := make([]ServerResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := query(server)
+			results[i] = ServerResult{Server: server, Response: resp, Err: err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func correctnessInterval(resp *ntp.Response) (time.Duration, time.Duration) {
+	distance := max(resp.RootDistance, minDistance)
+	return resp.ClockOffset - distance, resp.ClockOffset + distance
+}
+
+type edge struct {
+	offset time.Duration
+	// -1 - начало интервала, +1 - конец
+	kind int
+}
+
+// Алгоритм Марзулло: ищем отрезок, который пересекает наибольшее число интервалов корректности.
+// Серверы, чьи интервалы его не покрывают, считаются falsetickers.
+// Если пересечение не поддерживает большинство ответивших серверов, возвращается NoMajorityError
+func SelectTruechimers(results []ServerResult) (Selection, error) {
+	selection := Selection{}
+	responded := []ServerResult{}
+	for _, res := range results {
+		if res.Err != nil || res.Response == nil {
+			selection.Failed = append(selection.Failed, res)
+			continue
+		}
+		responded = append(responded, res)
+	}
+	if len(responded) == 0 {
+		return selection, ErrNoResponses
+	}
+
+	edges := make([]edge, 0, 2*len(responded))
+	for _, res := range responded {
+		low, high := correctnessInterval(res.Response)
+		edges = append(edges, edge{low, -1}, edge{high, 1})
+	}
+	// При равных смещениях начала идут раньше концов, так что касающиеся интервалы пересекаются
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].offset == edges[j].offset {
+			return edges[i].kind < edges[j].kind
+		}
+		return edges[i].offset < edges[j].offset
+	})
+
+	best, count := 0, 0
+	for i, e := range edges {
+		count -= e.kind
+		if count > best {
+			best = count
+			selection.Low = e.offset
+			selection.High = edges[i+1].offset
+		}
+	}
+
+	var weightSum, weightedOffset float64
+	for _, res := range responded {
+		low, high := correctnessInterval(res.Response)
+		if low > selection.Low || high < selection.High {
+			selection.Falsetickers = append(selection.Falsetickers, res)
+			continue
+		}
+		selection.Truechimers = append(selection.Truechimers, res)
+
+		// Чем меньше корневое расстояние, тем больше доверия серверу
+		weight := 1 / max(res.Response.RootDistance, minDistance).Seconds()
+		weightSum += weight
+		weightedOffset += weight * float64(res.Response.ClockOffset)
+	}
+
+	if 2*best <= len(responded) {
+		return selection, NoMajorityError{Agreed: best, Total: len(responded)}
+	}
+
+	selection.Offset = time.Duration(weightedOffset / weightSum)
+	return selection, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+const (
+	headerSize = 48
+
+	modeClient = 3
+	modeServer = 4
+)
+
+var ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type BadRequestError struct {
+	Reason string
+}
+
+func (err BadRequestError) Error() string {
+	return fmt.Sprintf("Bad NTP request: %s", err.Reason)
+}
+
+type BadReferenceIDError struct {
+	ID string
+}
+
+func (err BadReferenceIDError) Error() string {
+	return fmt.Sprintf("Reference ID %q is neither an IPv4 address nor at most 4 ASCII characters", err.ID)
+}
+
+func toNtpTime(t time.Time) uint64 {
+	d := t.Sub(ntpEpoch)
+	sec := uint64(d / time.Second)
+	frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+	return sec<<32 | frac
+}
+
+func toNtpTimeShort(d time.Duration) uint32 {
+	return uint32(uint64(d) << 16 / uint64(time.Second))
+}
+
+// Для stratum 2+ идентификатор - IPv4 адрес вышестоящего сервера, иначе - ASCII код вроде "GPS" или "LOCL"
+func ParseReferenceID(id string) (uint32, error) {
+	if ip := net.ParseIP(id).To4(); ip != nil {
+		return binary.BigEndian.Uint32(ip), nil
+	}
+	if len(id) > 4 {
+		return 0, BadReferenceIDError{id}
+	}
+
+	var b [4]byte
+	for i := range len(id) {
+		if id[i] < 32 || id[i] > 126 {
+			return 0, BadReferenceIDError{id}
+		}
+		b[i] = id[i]
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+// Расширение сервера (например, NTS): проверяет поля расширения запроса и дописывает свои к ответу.
+// Ошибка означает, что на запрос отвечать не нужно
+type ServerExtension interface {
+	ProcessReply(req []byte, reply *bytes.Buffer) error
+}
+
+// Минимальный SNTPv4 сервер (RFC 4330). Отдаёт локальное время, сдвинутое на смещение,
+// которое задано явно или получено от вышестоящего сервера
+type Server struct {
+	Stratum     uint8
+	ReferenceID uint32
+	Precision   int8
+	Leap        ntp.LeapIndicator
+	Extensions  []ServerExtension
+
+	mu             sync.RWMutex
+	offset         time.Duration
+	rootDelay      time.Duration
+	rootDispersion time.Duration
+	referenceTime  time.Time
+}
+
+func NewServer(stratum uint8, referenceID uint32) *Server {
+	return &Server{
+		Stratum:     stratum,
+		ReferenceID: referenceID,
+		Precision:   -20,
+	}
+}
+
+func (s *Server) SetOffset(offset time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = offset
+}
+
+// Запоминает результат опроса вышестоящего сервера, чтобы отдавать его время клиентам
+func (s *Server) Relay(resp *ntp.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = resp.ClockOffset
+	s.rootDelay = resp.RootDelay + resp.RTT
+	s.rootDispersion = resp.RootDispersion + resp.Precision
+	s.referenceTime = time.Now().Add(resp.ClockOffset)
+}
+
+func (s *Server) Reply(req []byte, received time.Time) ([]byte, error) {
+	if len(req) < headerSize {
+		return nil, BadRequestError{"the packet is too short"}
+	}
+	version := (req[0] >> 3) & 0x7
+	if req[0]&0x7 != modeClient {
+		return nil, BadRequestError{"not a client request"}
+	}
+	if version < 1 || version > 4 {
+		return nil, BadRequestError{fmt.Sprintf("unsupported version %d", version)}
+	}
+
+	s.mu.RLock()
+	offset, rootDelay, rootDispersion, referenceTime := s.offset, s.rootDelay, s.rootDispersion, s.referenceTime
+	s.mu.RUnlock()
+	if referenceTime.IsZero() {
+		// Без вышестоящего сервера эталоном считаются собственные часы
+		referenceTime = received.Add(offset)
+	}
+
+	reply := make([]byte, headerSize, 2*headerSize)
+	reply[0] = uint8(s.Leap)<<6 | version<<3 | modeServer
+	reply[1] = s.Stratum
+	reply[2] = req[2]
+	reply[3] = uint8(s.Precision)
+	binary.BigEndian.PutUint32(reply[4:8], toNtpTimeShort(rootDelay))
+	binary.BigEndian.PutUint32(reply[8:12], toNtpTimeShort(rootDispersion))
+	binary.BigEndian.PutUint32(reply[12:16], s.ReferenceID)
+	binary.BigEndian.PutUint64(reply[16:24], toNtpTime(referenceTime))
+	// Origin timestamp - это transmit timestamp клиента
+	copy(reply[24:32], req[40:48])
+	binary.BigEndian.PutUint64(reply[32:40], toNtpTime(received.Add(offset)))
+	binary.BigEndian.PutUint64(reply[40:48], toNtpTime(time.Now().Add(offset)))
+
+	buf := bytes.NewBuffer(reply)
+	for _, ext := range s.Extensions {
+		if err := ext.ProcessReply(req, buf); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Отвечает на запросы, пока conn не будет закрыт
+func (s *Server) Serve(conn net.PacketConn, l *log.Logger) error {
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		received := time.Now()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		reply, err := s.Reply(buf[:n], received)
+		if err != nil {
+			l.Printf("Ignoring a request from %s: %s\n", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(reply, addr); err != nil {
+			l.Printf("Error while replying to %s: %s\n", addr, err)
+		}
+	}
+}
+
+// Раз в interval опрашивает upstream и передаёт его смещение серверу, пока не закрыт stop
+func (s *Server) RelayFrom(upstream string, query QueryFunc, interval time.Duration, stop <-chan struct{}, l *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		resp, err := query(upstream)
+		if err != nil {
+			l.Printf("Error while querying the upstream %s: %s\n", upstream, err)
+			continue
+		}
+		s.Relay(resp)
+	}
+}
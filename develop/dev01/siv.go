@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+)
+
+// AEAD_AES_SIV_CMAC_256 (RFC 5297) - единственный алгоритм, который обязаны поддерживать NTS серверы.
+// В стандартной библиотеке его нет, поэтому он реализован здесь поверх crypto/aes
+
+const (
+	sivKeySize = 32
+	sivTagSize = aes.BlockSize
+)
+
+var ErrSIVOpen = errors.New("AES-SIV: message authentication failed")
+
+type SIV struct {
+	macBlock cipher.Block
+	ctrBlock cipher.Block
+}
+
+func NewSIV(key []byte) (*SIV, error) {
+	if len(key) != sivKeySize {
+		return nil, aes.KeySizeError(len(key))
+	}
+	macBlock, err := aes.NewCipher(key[:sivKeySize/2])
+	if err != nil {
+		return nil, err
+	}
+	ctrBlock, err := aes.NewCipher(key[sivKeySize/2:])
+	if err != nil {
+		return nil, err
+	}
+	return &SIV{macBlock: macBlock, ctrBlock: ctrBlock}, nil
+}
+
+// Умножение на x в GF(2^128), "dbl" из RFC 5297
+func dbl(block []byte) []byte {
+	result := make([]byte, aes.BlockSize)
+	carry := block[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		result[i] = block[i]<<1 | block[i+1]>>7
+	}
+	result[aes.BlockSize-1] = block[aes.BlockSize-1] << 1
+	if carry != 0 {
+		result[aes.BlockSize-1] ^= 0x87
+	}
+	return result
+}
+
+func xorInto(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// AES-CMAC из RFC 4493
+func cmac(block cipher.Block, message []byte) []byte {
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	k1 = dbl(k1)
+	k2 := dbl(k1)
+
+	mac := make([]byte, aes.BlockSize)
+	for len(message) > aes.BlockSize {
+		xorInto(mac, message[:aes.BlockSize])
+		block.Encrypt(mac, mac)
+		message = message[aes.BlockSize:]
+	}
+
+	last := make([]byte, aes.BlockSize)
+	copy(last, message)
+	if len(message) == aes.BlockSize {
+		xorInto(last, k1)
+	} else {
+		last[len(message)] = 0x80
+		xorInto(last, k2)
+	}
+	xorInto(mac, last)
+	block.Encrypt(mac, mac)
+	return mac
+}
+
+func (s *SIV) s2v(components [][]byte, plaintext []byte) []byte {
+	d := cmac(s.macBlock, make([]byte, aes.BlockSize))
+	for _, component := range components {
+		d = dbl(d)
+		xorInto(d, cmac(s.macBlock, component))
+	}
+
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = append([]byte{}, plaintext...)
+		xorInto(t[len(t)-aes.BlockSize:], d)
+	} else {
+		t = make([]byte, aes.BlockSize)
+		copy(t, plaintext)
+		t[len(plaintext)] = 0x80
+		xorInto(t, dbl(d))
+	}
+	return cmac(s.macBlock, t)
+}
+
+func (s *SIV) ctr(v, input []byte) []byte {
+	// Биты 31 и 63 счётчика обнуляются, чтобы упростить реализации с 32-битной арифметикой
+	q := append([]byte{}, v...)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+
+	output := make([]byte, len(input))
+	cipher.NewCTR(s.ctrBlock, q).XORKeyStream(output, input)
+	return output
+}
+
+// Nonce, как того требует RFC 5116, передаётся последним компонентом ассоциированных данных.
+// Пустой nonce означает детерминированный режим
+func (s *SIV) components(nonce []byte, additionalData [][]byte) [][]byte {
+	if len(nonce) == 0 {
+		return additionalData
+	}
+	return append(append([][]byte{}, additionalData...), nonce)
+}
+
+// Возвращает синтетический IV (он же тег) и шифротекст одним срезом
+func (s *SIV) Seal(nonce, plaintext []byte, additionalData ...[]byte) []byte {
+	v := s.s2v(s.components(nonce, additionalData), plaintext)
+	return append(v, s.ctr(v, plaintext)...)
+}
+
+func (s *SIV) Open(nonce, ciphertext []byte, additionalData ...[]byte) ([]byte, error) {
+	if len(ciphertext) < sivTagSize {
+		return nil, ErrSIVOpen
+	}
+	v := ciphertext[:sivTagSize]
+	plaintext := s.ctr(v, ciphertext[sivTagSize:])
+	expected := s.s2v(s.components(nonce, additionalData), plaintext)
+	if subtle.ConstantTimeCompare(v, expected) != 1 {
+		return nil, ErrSIVOpen
+	}
+	return plaintext, nil
+}
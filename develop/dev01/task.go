@@ -1,10 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/beevik/ntp"
 )
@@ -21,15 +28,427 @@ import (
 Программа должна проходить проверки go vet и golint.
 */
 
+const (
+	exitOK = 0
+	// Сервер не ответил или ответ не удалось разобрать. В режиме -watch - ни одного удачного измерения
+	// или -max-failures неудачных подряд
+	exitQueryFailed = 1
+	// Неверные аргументы командной строки, как у пакета flag
+	exitUsage = 2
+	// Ответ получен, но для синхронизации он не годится
+	exitInvalidResponse = 3
+	// В режиме -watch смещение или дрейф превысили порог
+	exitAlert = 4
+	// Ответ сервера не прошёл аутентификацию
+	exitAuthFailed = 5
+	// В режиме -set измерения разошлись или смещение больше допустимого шага
+	exitAdjustRefused = 6
+	// Часы не удалось подстроить, например, без прав root
+	exitAdjustFailed = 7
+)
+
+type OutputOptions struct {
+	verbose   bool
+	format    string
+	layout    TimeFormatter
+	zones     []*time.Location
+	corrected bool
+}
+
 func main() {
 	l := log.New(os.Stderr, "", 1)
-	var ntpUrl string
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		os.Exit(runServe(l, os.Args[2:]))
+	}
+
+	var (
+		ntpUrl, serverList string
+		output             OutputOptions
+		watch              bool
+		watchOptions       WatchOptions
+		useNTS             bool
+		ntsCA              string
+		layout, zones      string
+		keysFile, keyIDs   string
+		metricsAddr        string
+		fallbackList       string
+		timeout            time.Duration
+		policy             RetryPolicy
+		set                bool
+		adjustOptions      AdjustOptions
+	)
 	flag.StringVar(&ntpUrl, "url", "0.ru.pool.ntp.org", "The url of the remote NTP server")
+	flag.StringVar(&serverList, "servers", "", "Comma-separated list of NTP servers to query concurrently, falsetickers are discarded")
+	flag.BoolVar(&output.verbose, "verbose", false, "Print the detailed diagnostics of the NTP response")
+	flag.StringVar(&output.format, "format", formatText, "Output format: text or json")
+	flag.BoolVar(&watch, "watch", false, "Poll the server(s) continuously and track the local clock drift")
+	flag.DurationVar(&watchOptions.interval, "interval", 10*time.Second, "Polling interval in the -watch and -metrics-addr modes")
+	flag.IntVar(&watchOptions.historySize, "history", 60, "Number of the last offsets used to estimate the drift in the -watch mode")
+	flag.DurationVar(&watchOptions.maxOffset, "max-offset", 0, "Alert when the absolute offset exceeds this value, 0 disables the check")
+	flag.Float64Var(&watchOptions.maxDriftPPM, "max-drift", 0, "Alert when the absolute drift in ppm exceeds this value, 0 disables the check")
+	flag.IntVar(&watchOptions.count, "count", 0, "Number of polls in the -watch mode, 0 means forever")
+	flag.BoolVar(&watchOptions.exitOnAlert, "exit-on-alert", false, "Exit with a non-zero code on the first alert in the -watch mode")
+	flag.IntVar(&watchOptions.maxFailures, "max-failures", 0, "Exit with a non-zero code after this many failed polls in a row in the -watch mode, 0 disables the check")
+	flag.BoolVar(&useNTS, "nts", false, "Authenticate the queries with NTS, the servers are NTS-KE addresses (port 4460 by default)")
+	flag.StringVar(&ntsCA, "nts-ca", "", "PEM file with the CA certificates trusted for NTS-KE instead of the system ones")
+	flag.StringVar(&layout, "layout", "", "Time layout: rfc3339, rfc3339nano, unix, unixmilli, go:<Go layout> or strftime:<pattern>")
+	flag.StringVar(&zones, "zones", "", "Comma-separated list of IANA time zones to print the time in")
+	flag.BoolVar(&output.corrected, "corrected", false, "Print the corrected time alongside the system clock and the difference between them")
+	flag.StringVar(&keysFile, "keys", "", "ntp.keys-style file with the symmetric keys (MD5, SHA1, ...) used to authenticate the queries")
+	flag.StringVar(&keyIDs, "key-id", "", "Key id for all servers and/or per server: 5 or 5,host=7,host2=8")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Run as a Prometheus exporter serving /metrics on this address, the servers are polled every -interval")
+	flag.DurationVar(&timeout, "timeout", 5*time.Second, "Timeout of a single query")
+	flag.IntVar(&policy.Retries, "retries", 0, "Number of retries of a failed query to the same server")
+	flag.DurationVar(&policy.Backoff, "backoff", 500*time.Millisecond, "Pause before the first retry, doubled after each retry")
+	flag.StringVar(&fallbackList, "fallback", "", "Comma-separated list of NTP servers queried in order if -url fails")
+	flag.BoolVar(&set, "set", false, "Measure the offset several times and adjust the system clock (requires root)")
+	flag.BoolVar(&adjustOptions.dryRun, "dry-run", false, "In the -set mode only print the adjustment and an equivalent command")
+	flag.IntVar(&adjustOptions.samples, "samples", 4, "Number of offset measurements in the -set mode")
+	flag.DurationVar(&adjustOptions.sampleInterval, "sample-interval", time.Second, "Pause between the measurements in the -set mode")
+	flag.DurationVar(&adjustOptions.maxSpread, "max-spread", 100*time.Millisecond, "Refuse to adjust the clock if the measurements differ by more than this")
+	flag.DurationVar(&adjustOptions.maxStep, "max-step", 1000*time.Second, "Refuse to adjust the clock by more than this, 0 disables the check")
+	flag.DurationVar(&adjustOptions.slewThreshold, "slew-threshold", 128*time.Millisecond, "Offsets below this are slewed, the others are stepped")
 	flag.Parse()
 
-	time, err := ntp.Time(ntpUrl)
+	if output.format != formatText && output.format != formatJSON {
+		l.Println(UnknownFormatError{output.format})
+		os.Exit(exitUsage)
+	}
+	if watchOptions.maxFailures < 0 {
+		l.Println("-max-failures can't be negative, got ", watchOptions.maxFailures)
+		os.Exit(exitUsage)
+	}
+	if watchOptions.interval <= 0 {
+		l.Println("-interval must be positive, got ", watchOptions.interval)
+		os.Exit(exitUsage)
+	}
+	if policy.Retries < 0 || policy.Backoff < 0 {
+		l.Println("-retries and -backoff can't be negative")
+		os.Exit(exitUsage)
+	}
+	var err error
+	if output.layout, err = ParseLayout(layout); err != nil {
+		l.Println(err)
+		os.Exit(exitUsage)
+	}
+	if output.zones, err = ParseZones(zones); err != nil {
+		l.Println("Error while loading the time zones: ", err)
+		os.Exit(exitUsage)
+	}
+
+	var servers []string
+	if serverList != "" {
+		servers = strings.Split(serverList, ",")
+	}
+
+	options := ntp.QueryOptions{Timeout: timeout}
+	query := func(server string) (*ntp.Response, error) {
+		return ntp.QueryWithOptions(server, options)
+	}
+	if useNTS && keysFile != "" {
+		l.Println("NTS and symmetric key authentication can't be used together")
+		os.Exit(exitUsage)
+	}
+	if keysFile != "" {
+		keys, ids, err := loadKeys(keysFile, keyIDs)
+		if err != nil {
+			l.Println("Error while loading the keys: ", err)
+			os.Exit(exitUsage)
+		}
+		query = AuthenticatedQuery(keys, ids, options)
+	}
+	if useNTS {
+		config, err := tlsConfig(ntsCA)
+		if err != nil {
+			l.Println("Error while loading the NTS CA certificates: ", err)
+			os.Exit(exitUsage)
+		}
+		query = NewNTSClient(config, timeout).Query
+	}
+
+	// В одиночном режиме -url и запасные серверы опрашиваются по очереди
+	single := []string{ntpUrl}
+	if fallbackList != "" {
+		single = append(single, strings.Split(fallbackList, ",")...)
+	}
+
+	if set && (watch || metricsAddr != "") {
+		l.Println("-set can't be used together with -watch or -metrics-addr")
+		os.Exit(exitUsage)
+	}
+	if metricsAddr != "" {
+		if servers == nil {
+			servers = single
+		}
+		os.Exit(runExporter(l, policy.Wrap(l, query), servers, metricsAddr, watchOptions.interval))
+	}
+	if watch {
+		os.Exit(runWatch(l, query, policy, single, servers, watchOptions))
+	}
+	if set {
+		os.Exit(runSet(l, query, policy, single, servers, adjustOptions))
+	}
+	if servers != nil {
+		os.Exit(runMultiple(l, query, policy, servers, output))
+	}
+	os.Exit(runSingle(l, query, policy, single, output))
+}
+
+func loadKeys(keysFile, keyIDs string) (KeyRing, KeyIDs, error) {
+	keys, err := LoadKeys(keysFile)
+	if err != nil {
+		return nil, KeyIDs{}, err
+	}
+	ids, err := ParseKeyIDs(keyIDs)
+	if err != nil {
+		return nil, KeyIDs{}, err
+	}
+	return keys, ids, ids.Check(keys)
+}
+
+func tlsConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile == "" {
+		return config, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", caFile)
+	}
+	return config, nil
+}
+
+func exitCodeFor(err error) int {
+	var invalid InvalidResponseError
+	switch {
+	case isAuthError(err):
+		return exitAuthFailed
+	case errors.As(err, &invalid):
+		return exitInvalidResponse
+	}
+	return exitQueryFailed
+}
+
+func runSingle(l *log.Logger, query QueryFunc, policy RetryPolicy, servers []string, output OutputOptions) int {
+	server, resp, attempts, queryErr := QueryWithFallback(servers, policy, ValidatedQuery(query))
+	LogAttempts(l, attempts)
+	if resp == nil {
+		l.Println("Error while querying the time from the remote server: ", queryErr)
+		return exitCodeFor(queryErr)
+	}
+
+	var err error
+	report := NewReport(server, resp)
+	switch {
+	case output.format == formatJSON:
+		err = WriteJSON(os.Stdout, report)
+	case output.verbose:
+		err = WriteReport(os.Stdout, report)
+	case report.Valid:
+		WriteTime(os.Stdout, output, resp.ClockOffset)
+	}
+	if err != nil {
+		l.Println("Error while writing the report: ", err)
+		return exitQueryFailed
+	}
+
+	if queryErr != nil {
+		l.Println(queryErr)
+		return exitCodeFor(queryErr)
+	}
+	return exitOK
+}
+
+func runMultiple(l *log.Logger, query QueryFunc, policy RetryPolicy, servers []string, output OutputOptions) int {
+	results := QueryServers(servers, policy.Wrap(l, ValidatedQuery(query)))
+	selection, err := SelectTruechimers(results)
+	for _, res := range selection.Failed {
+		l.Printf("Error while querying %s: %s\n", res.Server, res.Err)
+	}
+
+	var writeErr error
+	switch {
+	case output.format == formatJSON:
+		writeErr = WriteJSON(os.Stdout, NewSelectionReport(results, selection, err))
+	case output.verbose:
+		writeErr = WriteSelectionReport(os.Stdout, NewSelectionReport(results, selection, err))
+	case err == nil:
+		WriteTime(os.Stdout, output, selection.Offset)
+		fmt.Println("Combined offset: ", selection.Offset)
+		fmt.Println("Agreed servers: ", serverNames(selection.Truechimers))
+		if len(selection.Falsetickers) != 0 {
+			fmt.Println("Discarded falsetickers: ", serverNames(selection.Falsetickers))
+		}
+	}
+	if writeErr != nil {
+		l.Println("Error while writing the report: ", writeErr)
+		return exitQueryFailed
+	}
+
+	if err != nil {
+		l.Println("Error while selecting the time from the remote servers: ", err)
+		// Если все серверы ответили, но ответы непригодны, это та же ошибка валидации
+		if errors.Is(err, ErrNoResponses) && allInvalid(selection.Failed) {
+			return exitInvalidResponse
+		}
+		return exitQueryFailed
+	}
+	return exitOK
+}
+
+// Измерение смещения для режимов с повторными опросами: один сервер с запасными или выбор из нескольких
+func offsetMeasurer(l *log.Logger, query QueryFunc, policy RetryPolicy, single, servers []string) func() (time.Duration, error) {
+	query = ValidatedQuery(query)
+	measure := func() (time.Duration, error) {
+		_, resp, attempts, err := QueryWithFallback(single, policy, query)
+		LogAttempts(l, attempts)
+		if err != nil {
+			return 0, err
+		}
+		return resp.ClockOffset, nil
+	}
+	if servers != nil {
+		measure = func() (time.Duration, error) {
+			results := QueryServers(servers, policy.Wrap(l, query))
+			selection, err := SelectTruechimers(results)
+			return selection.Offset, err
+		}
+	}
+	return measure
+}
+
+func runWatch(l *log.Logger, query QueryFunc, policy RetryPolicy, single, servers []string, options WatchOptions) int {
+	err := Watch(options, offsetMeasurer(l, query, policy, single, servers), os.Stdout, l)
+	if errors.Is(err, ErrAlert) {
+		l.Println(err)
+		return exitAlert
+	}
+	if err != nil {
+		l.Println(err)
+		return exitQueryFailed
+	}
+	return exitOK
+}
+
+func runSet(l *log.Logger, query QueryFunc, policy RetryPolicy, single, servers []string, options AdjustOptions) int {
+	samples, err := MeasureSamples(options, offsetMeasurer(l, query, policy, single, servers))
+	if err != nil {
+		l.Println("Error while measuring the offset: ", err)
+		return exitCodeFor(err)
+	}
+
+	adj, err := PlanAdjustment(samples, options)
 	if err != nil {
-		l.Fatal("Error while querying the time from the remote server: ", err)
+		l.Printf("Refusing to adjust the clock, samples %v: %s\n", samples, err)
+		return exitAdjustRefused
 	}
-	fmt.Println("The current time is: ", time)
+	if !options.dryRun {
+		if err := ApplyAdjustment(adj); err != nil {
+			l.Println("Error while adjusting the clock: ", err)
+			return exitAdjustFailed
+		}
+	}
+	WriteAdjustment(os.Stdout, adj, options.dryRun, time.Now())
+	return exitOK
+}
+
+func runExporter(l *log.Logger, query QueryFunc, servers []string, addr string, interval time.Duration) int {
+	exporter := NewExporter(servers, ValidatedQuery(query))
+	for _, res := range exporter.Refresh() {
+		if res.Err != nil {
+			l.Printf("Error while querying %s: %s\n", res.Server, res.Err)
+		}
+	}
+	go exporter.Run(interval, nil)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", exporter)
+	fmt.Printf("Serving metrics on %s/metrics\n", addr)
+	l.Println(http.ListenAndServe(addr, mux))
+	return exitQueryFailed
+}
+
+func runServe(l *log.Logger, args []string) int {
+	var (
+		addr, referenceID, upstream string
+		keysFile                    string
+		stratum                     uint
+		offset, upstreamInterval    time.Duration
+	)
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.StringVar(&addr, "addr", ":123", "UDP address to serve SNTP on")
+	flags.UintVar(&stratum, "stratum", 1, "Stratum reported to the clients")
+	flags.StringVar(&referenceID, "refid", "LOCL", "Reference ID reported to the clients: up to 4 ASCII characters or an IPv4 address")
+	flags.DurationVar(&offset, "offset", 0, "Constant offset added to the local clock")
+	flags.StringVar(&upstream, "upstream", "", "NTP server whose offset is relayed to the clients instead of -offset")
+	flags.DurationVar(&upstreamInterval, "upstream-interval", 64*time.Second, "Interval between the upstream queries")
+	flags.StringVar(&keysFile, "keys", "", "ntp.keys-style file, requests signed with these keys get signed replies")
+	flags.Parse(args)
+
+	if stratum > 15 {
+		l.Println("Stratum must be between 0 and 15, got ", stratum)
+		return exitUsage
+	}
+	if upstreamInterval <= 0 {
+		l.Println("-upstream-interval must be positive, got ", upstreamInterval)
+		return exitUsage
+	}
+	refID, err := ParseReferenceID(referenceID)
+	if err != nil {
+		l.Println(err)
+		return exitUsage
+	}
+
+	server := NewServer(uint8(stratum), refID)
+	server.SetOffset(offset)
+	if keysFile != "" {
+		keys, err := LoadKeys(keysFile)
+		if err != nil {
+			l.Println("Error while loading the keys: ", err)
+			return exitUsage
+		}
+		server.Extensions = append(server.Extensions, SymmetricKeyExtension{keys})
+	}
+	if upstream != "" {
+		query := ValidatedQuery(ntp.Query)
+		resp, err := query(upstream)
+		if err != nil {
+			l.Printf("Error while querying the upstream %s: %s\n", upstream, err)
+			return exitCodeFor(err)
+		}
+		server.Relay(resp)
+		go server.RelayFrom(upstream, query, upstreamInterval, nil, l)
+	}
+
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		l.Println("Error while listening: ", err)
+		return exitQueryFailed
+	}
+	defer conn.Close()
+
+	fmt.Printf("Serving SNTP on %s\n", conn.LocalAddr())
+	if err := server.Serve(conn, l); err != nil {
+		l.Println("Error while serving: ", err)
+		return exitQueryFailed
+	}
+	return exitOK
+}
+
+func allInvalid(results []ServerResult) bool {
+	for _, res := range results {
+		if exitCodeFor(res.Err) != exitInvalidResponse {
+			return false
+		}
+	}
+	return true
+}
+
+func serverNames(results []ServerResult) string {
+	return strings.Join(serverList(results), ", ")
 }
@@ -1 +1,1024 @@
 package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beevik/ntp"
+)
+
+func fakeResult(server string, offset, distance time.Duration) ServerResult {
+	return ServerResult{
+		Server:   server,
+		Response: &ntp.Response{ClockOffset: offset, RootDistance: distance},
+	}
+}
+
+func TestSelectTruechimers(t *testing.T) {
+	t.Run("One falseticker is discarded", func(t *testing.T) {
+		results := []ServerResult{
+			fakeResult("a", 10*time.Millisecond, 20*time.Millisecond),
+			fakeResult("b", 12*time.Millisecond, 20*time.Millisecond),
+			fakeResult("c", 5*time.Second, 20*time.Millisecond),
+			fakeResult("d", 8*time.Millisecond, 20*time.Millisecond),
+		}
+
+		selection, err := SelectTruechimers(results)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+
+		if names := serverNames(selection.Truechimers); names != "a, b, d" {
+			t.Fatalf("Wrong truechimers:\nexpected %s,\nrecieved %s", "a, b, d", names)
+		}
+		if names := serverNames(selection.Falsetickers); names != "c" {
+			t.Fatalf("Wrong falsetickers:\nexpected %s,\nrecieved %s", "c", names)
+		}
+		if selection.Offset != 10*time.Millisecond {
+			t.Fatalf("Wrong offset:\nexpected %s,\nrecieved %s", 10*time.Millisecond, selection.Offset)
+		}
+	})
+
+	t.Run("Closer servers weigh more", func(t *testing.T) {
+		results := []ServerResult{
+			fakeResult("a", 0, 10*time.Millisecond),
+			fakeResult("b", 9*time.Millisecond, 40*time.Millisecond),
+		}
+
+		selection, err := SelectTruechimers(results)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if selection.Offset <= 0 || selection.Offset >= 4500*time.Microsecond {
+			t.Fatal("Offset should lean towards the closer server, got ", selection.Offset)
+		}
+	})
+
+	t.Run("Failed servers are not counted", func(t *testing.T) {
+		results := []ServerResult{
+			fakeResult("a", time.Millisecond, 10*time.Millisecond),
+			{Server: "b", Err: errors.New("timeout")},
+		}
+
+		selection, err := SelectTruechimers(results)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if len(selection.Failed) != 1 || selection.Failed[0].Server != "b" {
+			t.Fatal("Expected server b to be reported as failed, got ", selection.Failed)
+		}
+	})
+
+	t.Run("No majority", func(t *testing.T) {
+		results := []ServerResult{
+			fakeResult("a", 0, 10*time.Millisecond),
+			fakeResult("b", time.Second, 10*time.Millisecond),
+		}
+
+		_, err := SelectTruechimers(results)
+		var noMajority NoMajorityError
+		if !errors.As(err, &noMajority) {
+			t.Fatal("Expected NoMajorityError, got ", err)
+		}
+	})
+
+	t.Run("No responses", func(t *testing.T) {
+		_, err := SelectTruechimers([]ServerResult{{Server: "a", Err: errors.New("timeout")}})
+		if !errors.Is(err, ErrNoResponses) {
+			t.Fatal("Expected ErrNoResponses, got ", err)
+		}
+	})
+}
+
+func TestQueryServers(t *testing.T) {
+	servers := []string{"a", "b", "c"}
+	results := QueryServers(servers, func(server string) (*ntp.Response, error) {
+		if server == "b" {
+			return nil, errors.New("unreachable")
+		}
+		return &ntp.Response{Stratum: 2}, nil
+	})
+
+	received := []string{}
+	for _, res := range results {
+		received = append(received, res.Server)
+	}
+	if !slices.Equal(received, servers) {
+		t.Fatalf("Wrong order of results:\nexpected %v,\nrecieved %v", servers, received)
+	}
+	if results[1].Err == nil || results[0].Err != nil || results[2].Err != nil {
+		t.Fatal("Errors were attributed to the wrong servers: ", results)
+	}
+}
+
+func TestReport(t *testing.T) {
+	now := time.Now()
+	resp := &ntp.Response{
+		Time:          now,
+		ClockOffset:   3 * time.Millisecond,
+		RTT:           10 * time.Millisecond,
+		Stratum:       1,
+		ReferenceID:   0x47505300, // "GPS"
+		ReferenceTime: now.Add(-time.Second),
+		Leap:          ntp.LeapNoWarning,
+		Version:       4,
+	}
+
+	t.Run("JSON report of a valid response", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := WriteJSON(&b, NewReport("local", resp)); err != nil {
+			t.Fatal("Error while writing the report: ", err)
+		}
+
+		decoded := map[string]any{}
+		if err := json.Unmarshal(b.Bytes(), &decoded); err != nil {
+			t.Fatal("Error while decoding the report: ", err)
+		}
+		expected := map[string]any{
+			"server":          "local",
+			"clock_offset_ns": float64(3 * time.Millisecond),
+			"rtt_ns":          float64(10 * time.Millisecond),
+			"stratum":         float64(1),
+			"reference_id":    ".GPS.",
+			"leap":            "no warning",
+			"valid":           true,
+		}
+		for key, value := range expected {
+			if decoded[key] != value {
+				t.Fatalf("Wrong value of %s:\nexpected %v,\nrecieved %v", key, value, decoded[key])
+			}
+		}
+	})
+
+	t.Run("Text report of a kiss of death", func(t *testing.T) {
+		kod := *resp
+		kod.Stratum = 0
+		kod.KissCode = "RATE"
+
+		var b bytes.Buffer
+		report := NewReport("local", &kod)
+		if report.Valid {
+			t.Fatal("Kiss of death should not be valid")
+		}
+		if err := WriteReport(&b, report); err != nil {
+			t.Fatal("Error while writing the report: ", err)
+		}
+		for _, line := range []string{"Kiss code: ", "RATE", "Valid: ", "kiss of death received"} {
+			if !strings.Contains(b.String(), line) {
+				t.Fatalf("Report doesn't contain %q:\n%s", line, b.String())
+			}
+		}
+	})
+
+	t.Run("Validation errors are distinguished", func(t *testing.T) {
+		unsynced := *resp
+		unsynced.Leap = ntp.LeapNotInSync
+		query := ValidatedQuery(func(string) (*ntp.Response, error) { return &unsynced, nil })
+
+		got, err := query("local")
+		if got == nil || !errors.Is(err, ntp.ErrInvalidLeapSecond) || exitCodeFor(err) != exitInvalidResponse {
+			t.Fatal("Expected an invalid response error with the response kept, got ", err)
+		}
+		if exitCodeFor(errors.New("timeout")) != exitQueryFailed {
+			t.Fatal("Query errors should not be reported as invalid responses")
+		}
+	})
+}
+
+// Локальный SNTP сервер для тестов
+func startServer(t *testing.T, server *Server) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error while starting the server: ", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go server.Serve(conn, log.New(io.Discard, "", 0))
+	return conn.LocalAddr().String()
+}
+
+// Сервер, время которого отличается от системного на offset
+func startFakeServer(t *testing.T, offset time.Duration) string {
+	server := NewServer(1, 0x4c4f434c) // "LOCL"
+	server.SetOffset(offset)
+	return startServer(t, server)
+}
+
+func TestDrift(t *testing.T) {
+	start := time.Now()
+	history := NewHistory(5)
+	if _, ok := history.DriftPPM(); ok {
+		t.Fatal("Drift can't be estimated without samples")
+	}
+
+	// Локальные часы спешат на 50 ppm: смещение сервера уменьшается на 50 мкс каждую секунду.
+	// Первые сэмплы с другим наклоном должны вытесниться из истории
+	for i := range 5 {
+		history.Add(Sample{At: start.Add(time.Duration(i) * time.Second), Offset: time.Duration(i) * time.Second})
+	}
+	for i := 5; i < 10; i++ {
+		history.Add(Sample{At: start.Add(time.Duration(i) * time.Second), Offset: -time.Duration(i) * 50 * time.Microsecond})
+	}
+
+	drift, ok := history.DriftPPM()
+	if !ok {
+		t.Fatal("Drift should be estimated")
+	}
+	if math.Abs(drift-50) > 1e-6 {
+		t.Fatalf("Wrong drift:\nexpected %v,\nrecieved %v", 50, drift)
+	}
+	if len(history.Samples()) != 5 || !history.Samples()[0].At.Equal(start.Add(5*time.Second)) {
+		t.Fatal("History should keep only the last samples in order, got ", history.Samples())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	query := ValidatedQuery(ntp.Query)
+	measureFrom := func(server string) func() (time.Duration, error) {
+		return func() (time.Duration, error) {
+			resp, err := query(server)
+			if err != nil {
+				return 0, err
+			}
+			return resp.ClockOffset, nil
+		}
+	}
+	l := log.New(io.Discard, "", 0)
+
+	t.Run("No alerts while in sync", func(t *testing.T) {
+		measure := measureFrom(startFakeServer(t, 0))
+		var b bytes.Buffer
+		options := WatchOptions{interval: 10 * time.Millisecond, historySize: 10, maxOffset: 100 * time.Millisecond, count: 3, exitOnAlert: true}
+		if err := Watch(options, measure, &b, l); err != nil {
+			t.Fatal("Unexpected error: ", err, "\n", b.String())
+		}
+		if lines := strings.Count(b.String(), "offset="); lines != 3 {
+			t.Fatalf("Expected 3 measurements, got %d:\n%s", lines, b.String())
+		}
+	})
+
+	t.Run("Alert on a big offset", func(t *testing.T) {
+		measure := measureFrom(startFakeServer(t, time.Second))
+		var b bytes.Buffer
+		options := WatchOptions{interval: 10 * time.Millisecond, historySize: 10, maxOffset: 100 * time.Millisecond, count: 3, exitOnAlert: true}
+		if err := Watch(options, measure, &b, l); !errors.Is(err, ErrAlert) {
+			t.Fatal("Expected ErrAlert, got ", err)
+		}
+		if !strings.Contains(b.String(), "ALERT: offset") {
+			t.Fatal("Expected an alert line, got:\n", b.String())
+		}
+	})
+
+	t.Run("Failed measurements", func(t *testing.T) {
+		calls := 0
+		failing := func() (time.Duration, error) {
+			calls++
+			return 0, errors.New("timeout")
+		}
+		var b bytes.Buffer
+		options := WatchOptions{interval: time.Millisecond, historySize: 10, count: 3}
+		if err := Watch(options, failing, &b, l); !errors.Is(err, ErrNoMeasurements) || calls != 3 {
+			t.Fatal("Expected ErrNoMeasurements after 3 polls, got ", err, calls)
+		}
+
+		calls = 0
+		options = WatchOptions{interval: time.Millisecond, historySize: 10, maxFailures: 2}
+		if err := Watch(options, failing, &b, l); !errors.Is(err, ErrTooManyFailures) || calls != 2 {
+			t.Fatal("Expected ErrTooManyFailures after 2 polls, got ", err, calls)
+		}
+	})
+}
+
+func TestServer(t *testing.T) {
+	t.Run("Client gets the configured fields", func(t *testing.T) {
+		refID, err := ParseReferenceID("GPS")
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		server := NewServer(1, refID)
+		server.SetOffset(-2 * time.Second)
+
+		resp, err := ntp.Query(startServer(t, server))
+		if err != nil {
+			t.Fatal("Error while querying the server: ", err)
+		}
+		if err := resp.Validate(); err != nil {
+			t.Fatal("The response should be valid: ", err)
+		}
+		if resp.Stratum != 1 || resp.ReferenceString() != ".GPS." || resp.Version != 4 {
+			t.Fatalf("Wrong header fields: stratum %d, reference %s, version %d", resp.Stratum, resp.ReferenceString(), resp.Version)
+		}
+		if (resp.ClockOffset + 2*time.Second).Abs() > 50*time.Millisecond {
+			t.Fatal("Wrong offset: ", resp.ClockOffset)
+		}
+	})
+
+	t.Run("Relayed upstream offset", func(t *testing.T) {
+		upstream := startFakeServer(t, 3*time.Second)
+		refID, _ := ParseReferenceID("127.0.0.1")
+		server := NewServer(2, refID)
+		resp, err := ntp.Query(upstream)
+		if err != nil {
+			t.Fatal("Error while querying the upstream: ", err)
+		}
+		server.Relay(resp)
+
+		resp, err = ntp.Query(startServer(t, server))
+		if err != nil {
+			t.Fatal("Error while querying the server: ", err)
+		}
+		if resp.ReferenceString() != "127.0.0.1" || resp.Stratum != 2 {
+			t.Fatal("Wrong reference: ", resp.ReferenceString())
+		}
+		if (resp.ClockOffset - 3*time.Second).Abs() > 50*time.Millisecond {
+			t.Fatal("Wrong offset: ", resp.ClockOffset)
+		}
+	})
+
+	t.Run("Kiss of death", func(t *testing.T) {
+		refID, _ := ParseReferenceID("RATE")
+		resp, err := ntp.Query(startServer(t, NewServer(0, refID)))
+		if err != nil {
+			t.Fatal("Error while querying the server: ", err)
+		}
+		if !resp.IsKissOfDeath() || resp.KissCode != "RATE" {
+			t.Fatal("Expected a kiss of death, got stratum ", resp.Stratum)
+		}
+	})
+
+	t.Run("Bad requests", func(t *testing.T) {
+		server := NewServer(1, 0)
+		request := make([]byte, headerSize)
+		request[0] = 4<<3 | modeServer
+		for _, req := range [][]byte{request[:20], request} {
+			if _, err := server.Reply(req, time.Now()); err == nil {
+				t.Fatal("Expected an error for the request ", req)
+			}
+		}
+	})
+
+	t.Run("Bad reference IDs", func(t *testing.T) {
+		for _, id := range []string{"TOOLONG", "A\x01"} {
+			if _, err := ParseReferenceID(id); err == nil {
+				t.Fatal("Expected an error for ", id)
+			}
+		}
+	})
+}
+
+func TestSIV(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// Тестовые векторы из RFC 5297, приложение A
+	testCases := []struct {
+		key, nonce, plaintext, output string
+		additionalData                []string
+		hint                          string
+	}{
+		{
+			key:            "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff",
+			additionalData: []string{"101112131415161718191a1b1c1d1e1f2021222324252627"},
+			plaintext:      "112233445566778899aabbccddee",
+			output:         "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c",
+			hint:           "Deterministic authenticated encryption",
+		},
+		{
+			key:            "7f7e7d7c7b7a79787776757473727170404142434445464748494a4b4c4d4e4f",
+			additionalData: []string{"00112233445566778899aabbccddeeffdeaddadadeaddadaffeeddccbbaa99887766554433221100", "102030405060708090a0"},
+			nonce:          "09f911029d74e35bd84156c5635688c0",
+			plaintext:      "7468697320697320736f6d6520706c61696e7465787420746f20656e6372797074207573696e67205349562d414553",
+			output:         "7bdb6e3b432667eb06f4d14bff2fbd0fcb900f2fddbe404326601965c889bf17dba77ceb094fa663b7a3f748ba8af829ea64ad544a272e9c485b62a3fd5c0d",
+			hint:           "Nonce-based authenticated encryption",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			siv, err := NewSIV(decode(test.key))
+			if err != nil {
+				t.Fatal("Unexpected error: ", err)
+			}
+			additionalData := [][]byte{}
+			for _, ad := range test.additionalData {
+				additionalData = append(additionalData, decode(ad))
+			}
+
+			output := siv.Seal(decode(test.nonce), decode(test.plaintext), additionalData...)
+			if hex.EncodeToString(output) != test.output {
+				t.Fatalf("Wrong output:\nexpected %s,\nrecieved %x", test.output, output)
+			}
+
+			plaintext, err := siv.Open(decode(test.nonce), output, additionalData...)
+			if err != nil || hex.EncodeToString(plaintext) != test.plaintext {
+				t.Fatal("Couldn't open the sealed message: ", err)
+			}
+
+			output[len(output)-1] ^= 1
+			if _, err := siv.Open(decode(test.nonce), output, additionalData...); !errors.Is(err, ErrSIVOpen) {
+				t.Fatal("Expected ErrSIVOpen for a tampered message, got ", err)
+			}
+		})
+	}
+}
+
+type ntsKeys struct {
+	c2s, s2c *SIV
+}
+
+// Тестовый NTS сервер: NTS-KE по TLS и расширение для SNTP сервера, проверяющее запросы.
+// Cookie - просто случайный идентификатор ключей, хранящихся на сервере
+type ntsStandIn struct {
+	// Портить аутентификатор ответа
+	tamper bool
+
+	mu      sync.Mutex
+	cookies map[string]ntsKeys
+}
+
+func (n *ntsStandIn) newCookie(keys ntsKeys) []byte {
+	cookie := make([]byte, 16)
+	rand.Read(cookie)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cookies[string(cookie)] = keys
+	return cookie
+}
+
+func (n *ntsStandIn) handleKE(conn *tls.Conn, ntpPort int) {
+	defer conn.Close()
+	for {
+		record, err := readKERecord(conn)
+		if err != nil {
+			return
+		}
+		if record.typ == keEndOfMessage {
+			break
+		}
+	}
+
+	c2s, s2c, err := exportNTSKeys(conn.ConnectionState())
+	if err != nil {
+		return
+	}
+	var response bytes.Buffer
+	writeKERecord(&response, ntsKERecord{critical: true, typ: keNextProtocol, body: uint16Body(ntsProtocolNTPv4)})
+	writeKERecord(&response, ntsKERecord{critical: true, typ: keAEADAlgorithm, body: uint16Body(ntsAEADSIV256)})
+	writeKERecord(&response, ntsKERecord{typ: keNTPv4Server, body: []byte("127.0.0.1")})
+	writeKERecord(&response, ntsKERecord{typ: keNTPv4Port, body: uint16Body(uint16(ntpPort))})
+	for range ntsMaxCookie {
+		writeKERecord(&response, ntsKERecord{typ: keNewCookie, body: n.newCookie(ntsKeys{c2s, s2c})})
+	}
+	writeKERecord(&response, ntsKERecord{critical: true, typ: keEndOfMessage})
+	conn.Write(response.Bytes())
+}
+
+func (n *ntsStandIn) ProcessReply(req []byte, reply *bytes.Buffer) error {
+	fields, err := parseExtensionFields(req, headerSize)
+	if err != nil {
+		return err
+	}
+
+	var uid []byte
+	var keys ntsKeys
+	found, requested := false, 0
+	for _, field := range fields {
+		switch field.typ {
+		case extUniqueIdentifier:
+			uid = field.body
+		case extCookie:
+			n.mu.Lock()
+			keys, found = n.cookies[string(field.body)]
+			n.mu.Unlock()
+			requested++
+		case extCookiePlaceholder:
+			requested++
+		}
+	}
+	if !found {
+		return errors.New("unknown cookie")
+	}
+	if _, err := openAuthenticator(req, fields, keys.c2s); err != nil {
+		return err
+	}
+
+	appendExtensionField(reply, extUniqueIdentifier, uid)
+	var plaintext bytes.Buffer
+	for range requested {
+		appendExtensionField(&plaintext, extCookie, n.newCookie(keys))
+	}
+	if err := appendAuthenticator(reply, keys.s2c, plaintext.Bytes()); err != nil {
+		return err
+	}
+	if n.tamper {
+		reply.Bytes()[reply.Len()-1] ^= 1
+	}
+	return nil
+}
+
+func selfSignedCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// Запускает NTS-KE и NTP части тестового сервера, возвращает адрес NTS-KE и доверенные сертификаты
+func startNTSStandIn(t *testing.T, tamper bool) (string, *x509.CertPool) {
+	standIn := &ntsStandIn{tamper: tamper, cookies: map[string]ntsKeys{}}
+	server := NewServer(1, 0x4e545300) // "NTS"
+	server.Extensions = []ServerExtension{standIn}
+	_, ntpPort, _ := net.SplitHostPort(startServer(t, server))
+	port, _ := strconv.Atoi(ntpPort)
+
+	cert, pool := selfSignedCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{ntsALPN},
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatal("Error while starting the NTS-KE server: ", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go standIn.handleKE(conn.(*tls.Conn), port)
+		}
+	}()
+	return listener.Addr().String(), pool
+}
+
+func TestNTS(t *testing.T) {
+	t.Run("Authenticated queries", func(t *testing.T) {
+		addr, pool := startNTSStandIn(t, false)
+		client := NewNTSClient(&tls.Config{RootCAs: pool}, time.Second)
+
+		// Cookies больше, чем выдаётся при обмене ключами, так что они должны пополняться из ответов
+		for i := range 2 * ntsMaxCookie {
+			resp, err := client.Query(addr)
+			if err != nil {
+				t.Fatalf("Error in query %d: %s", i, err)
+			}
+			if err := resp.Validate(); err != nil {
+				t.Fatal("The response should be valid: ", err)
+			}
+		}
+		if cookies := client.sessions[addr].Cookies(); cookies != ntsMaxCookie {
+			t.Fatalf("Wrong number of cookies:\nexpected %d,\nrecieved %d", ntsMaxCookie, cookies)
+		}
+	})
+
+	t.Run("Tampered response", func(t *testing.T) {
+		addr, pool := startNTSStandIn(t, true)
+		_, err := NewNTSClient(&tls.Config{RootCAs: pool}, time.Second).Query(addr)
+		if !errors.Is(err, ErrNTSAuthFailed) || exitCodeFor(err) != exitAuthFailed {
+			t.Fatal("Expected ErrNTSAuthFailed, got ", err)
+		}
+	})
+
+	t.Run("Untrusted certificate", func(t *testing.T) {
+		addr, _ := startNTSStandIn(t, false)
+		_, err := NewNTSClient(&tls.Config{RootCAs: x509.NewCertPool()}, time.Second).Query(addr)
+		if err == nil || exitCodeFor(err) != exitAuthFailed {
+			t.Fatal("Expected a certificate verification error, got ", err)
+		}
+	})
+}
+
+func TestFormat(t *testing.T) {
+	moment := time.Date(2024, 3, 5, 7, 8, 9, 12345, time.UTC)
+
+	testCases := []struct {
+		layout string
+		output string
+	}{
+		{"", "2024-03-05 07:08:09.000012345 +0000 UTC"},
+		{"rfc3339", "2024-03-05T07:08:09Z"},
+		{"rfc3339nano", "2024-03-05T07:08:09.000012345Z"},
+		{"unix", "1709622489"},
+		{"unixmilli", "1709622489000"},
+		{"go:02.01.2006 15:04", "05.03.2024 07:08"},
+		{"strftime:%Y-%m-%d %H:%M:%S.%N %Z %%", "2024-03-05 07:08:09.000012345 UTC %"},
+		{"strftime:%a %b %e %j %I%p %s", "Tue Mar  5 065 07AM 1709622489"},
+	}
+	for _, test := range testCases {
+		t.Run(test.layout, func(t *testing.T) {
+			formatter, err := ParseLayout(test.layout)
+			if err != nil {
+				t.Fatal("Unexpected error: ", err)
+			}
+			if output := formatter(moment); output != test.output {
+				t.Fatalf("Wrong output:\nexpected %s,\nrecieved %s", test.output, output)
+			}
+		})
+	}
+
+	for _, layout := range []string{"iso", "strftime:%Q", "strftime:100%"} {
+		t.Run("Bad layout "+layout, func(t *testing.T) {
+			if _, err := ParseLayout(layout); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+
+	t.Run("Corrected time in several zones", func(t *testing.T) {
+		layout, _ := ParseLayout("go:MST")
+		zones, err := ParseZones("Europe/Moscow, Asia/Tokyo")
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+
+		var b bytes.Buffer
+		WriteTime(&b, OutputOptions{layout: layout, zones: zones, corrected: true}, 2*time.Second)
+		for _, line := range []string{"System clock:", "Corrected time:", "Difference:      2s", "Europe/Moscow: MSK", "Asia/Tokyo: JST"} {
+			if !strings.Contains(b.String(), line) {
+				t.Fatalf("Output doesn't contain %q:\n%s", line, b.String())
+			}
+		}
+	})
+}
+
+const testKeys = `# keyid type key
+1 MD5 secret-md5
+2 SHA1 8d7a2c6ef1e2a3b4c5d6e7f8091a2b3c4d5e6f70 127.0.0.1
+3 AES128CMAC 000102030405060708090a0b0c0d0e0f
+4 sha256 another # lowercase type
+
+5 MD5 wrong-secret
+`
+
+func TestSymmetricKeys(t *testing.T) {
+	keys, err := ParseKeys(strings.NewReader(testKeys))
+	if err != nil {
+		t.Fatal("Error while parsing the keys: ", err)
+	}
+	if len(keys) != 5 || keys[2].Type != ntp.AuthSHA1 || len(keys[2].Secret) != 20 || string(keys[1].Secret) != "secret-md5" {
+		t.Fatal("Wrong keys: ", keys)
+	}
+
+	serverKeys := KeyRing{}
+	for id, key := range keys {
+		serverKeys[id] = key
+	}
+	// У сервера другой секрет для ключа 5
+	serverKeys[5] = SymmetricKey{ID: 5, Type: ntp.AuthMD5, Secret: []byte("server-secret")}
+	server := NewServer(2, 0x7f000001)
+	server.Extensions = []ServerExtension{SymmetricKeyExtension{serverKeys}}
+	addr := startServer(t, server)
+	unsigned := startFakeServer(t, 0)
+
+	for _, id := range []uint16{1, 2, 3, 4} {
+		t.Run(fmt.Sprintf("Authenticated with key %d", id), func(t *testing.T) {
+			query := AuthenticatedQuery(keys, KeyIDs{Default: id}, ntp.QueryOptions{})
+			resp, err := query(addr)
+			if err != nil {
+				t.Fatal("Unexpected error: ", err)
+			}
+			if err := resp.Validate(); err != nil {
+				t.Fatal("The response should be valid: ", err)
+			}
+		})
+	}
+
+	t.Run("MAC doesn't verify", func(t *testing.T) {
+		query := AuthenticatedQuery(keys, KeyIDs{PerServer: map[string]uint16{addr: 5}}, ntp.QueryOptions{})
+		_, err := query(addr)
+		var authErr SymmetricAuthError
+		if !errors.As(err, &authErr) || authErr.KeyID != 5 || exitCodeFor(err) != exitAuthFailed {
+			t.Fatal("Expected SymmetricAuthError, got ", err)
+		}
+	})
+
+	t.Run("Unsigned response", func(t *testing.T) {
+		_, err := AuthenticatedQuery(keys, KeyIDs{Default: 1}, ntp.QueryOptions{})(unsigned)
+		if !errors.Is(err, ntp.ErrAuthFailed) {
+			t.Fatal("Expected ErrAuthFailed, got ", err)
+		}
+	})
+
+	t.Run("Key ids", func(t *testing.T) {
+		ids, err := ParseKeyIDs("2,a=1, b = 3")
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if ids.For("a") != 1 || ids.For("b") != 3 || ids.For("c") != 2 || ids.Check(keys) != nil {
+			t.Fatal("Wrong key ids: ", ids)
+		}
+		if ids, _ := ParseKeyIDs("a=9"); ids.Check(keys) == nil {
+			t.Fatal("Expected an error for an unknown key")
+		}
+		if _, err := ParseKeyIDs("a=x"); err == nil {
+			t.Fatal("Expected an error for a bad key id")
+		}
+	})
+
+	badFiles := []struct {
+		file string
+		hint string
+	}{
+		{"1 MD5", "Missing key"},
+		{"0 MD5 secret", "Zero key id"},
+		{"1 DES secret", "Unsupported type"},
+		{"1 MD5 abc", "Too short key"},
+		{"1 MD5 zz0102030405060708090a0b0c0d0e0f", "Long key that is not hex"},
+		{"1 AES128CMAC secret", "Wrong AES key size"},
+		{"1 MD5 secret\n1 SHA1 secret", "Duplicate id"},
+	}
+	for _, test := range badFiles {
+		t.Run(test.hint, func(t *testing.T) {
+			var fileErr KeysFileError
+			if _, err := ParseKeys(strings.NewReader(test.file)); !errors.As(err, &fileErr) {
+				t.Fatal("Expected KeysFileError, got ", err)
+			}
+		})
+	}
+}
+
+func TestExporter(t *testing.T) {
+	good := startFakeServer(t, 250*time.Millisecond)
+	// На закрытый порт сразу приходит connection refused
+	bad := "127.0.0.1:1"
+	exporter := NewExporter([]string{good, bad}, ValidatedQuery(ntp.Query))
+	exporter.Refresh()
+	exporter.Refresh()
+
+	server := httptest.NewServer(exporter)
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal("Error while fetching the metrics: ", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	metrics := string(body)
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatal("Wrong content type: ", resp.Header.Get("Content-Type"))
+	}
+	expected := []string{
+		"# TYPE ntp_offset_seconds gauge",
+		fmt.Sprintf("ntp_up{server=%q} 1", good),
+		fmt.Sprintf("ntp_up{server=%q} 0", bad),
+		fmt.Sprintf("ntp_stratum{server=%q} 1", good),
+		fmt.Sprintf("ntp_query_errors_total{server=%q} 2", bad),
+		fmt.Sprintf("ntp_query_errors_total{server=%q} 0", good),
+		fmt.Sprintf("ntp_rtt_seconds{server=%q}", good),
+		fmt.Sprintf("ntp_last_success_timestamp_seconds{server=%q}", good),
+	}
+	for _, line := range expected {
+		if !strings.Contains(metrics, line) {
+			t.Fatalf("Metrics don't contain %q:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, fmt.Sprintf("ntp_offset_seconds{server=%q}", bad)) {
+		t.Fatal("Offset of a server that never responded shouldn't be exported:\n", metrics)
+	}
+
+	var offset float64
+	prefix := fmt.Sprintf("ntp_offset_seconds{server=%q} ", good)
+	for _, line := range strings.Split(metrics, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			offset, _ = strconv.ParseFloat(strings.TrimPrefix(line, prefix), 64)
+		}
+	}
+	if math.Abs(offset-0.25) > 0.05 {
+		t.Fatal("Wrong offset: ", offset)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	calls := map[string]int{}
+	var mu sync.Mutex
+	flaky := func(server string) (*ntp.Response, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[server]++
+		switch {
+		case server == "flaky" && calls[server] < 3:
+			return nil, errors.New("timeout")
+		case server == "kod":
+			return &ntp.Response{Stratum: 0}, InvalidResponseError{ntp.ErrKissOfDeath}
+		case server == "down":
+			return nil, errors.New("connection refused")
+		}
+		return &ntp.Response{Stratum: 2}, nil
+	}
+	policy := RetryPolicy{Retries: 2, Backoff: 5 * time.Millisecond}
+
+	t.Run("Retries with backoff", func(t *testing.T) {
+		start := time.Now()
+		resp, attempts, err := policy.Query("flaky", flaky)
+		if err != nil || resp == nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if len(attempts) != 2 || calls["flaky"] != 3 {
+			t.Fatalf("Expected 2 failed attempts out of 3, got %d of %d", len(attempts), calls["flaky"])
+		}
+		if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+			t.Fatal("Backoff should double: 5ms + 10ms, elapsed ", elapsed)
+		}
+	})
+
+	t.Run("Invalid responses are not retried", func(t *testing.T) {
+		_, attempts, err := policy.Query("kod", flaky)
+		if len(attempts) != 1 || exitCodeFor(err) != exitInvalidResponse {
+			t.Fatal("Expected a single attempt with an invalid response, got ", attempts)
+		}
+	})
+
+	t.Run("Negative retries", func(t *testing.T) {
+		_, attempts, err := RetryPolicy{Retries: -1}.Query("down", flaky)
+		if len(attempts) != 1 || err == nil {
+			t.Fatal("Expected a single failed attempt, got ", attempts)
+		}
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		server, resp, attempts, err := QueryWithFallback([]string{"down", "kod", "up"}, policy, flaky)
+		if err != nil || server != "up" || resp.Stratum != 2 {
+			t.Fatal("Expected the answer of the last server, got ", server, err)
+		}
+
+		summary := []string{}
+		for _, attempt := range attempts {
+			summary = append(summary, fmt.Sprintf("%s#%d", attempt.Server, attempt.Number))
+		}
+		expected := []string{"down#1", "down#2", "down#3", "kod#1"}
+		if !slices.Equal(summary, expected) {
+			t.Fatalf("Wrong attempts:\nexpected %v,\nrecieved %v", expected, summary)
+		}
+	})
+
+	t.Run("Attempts of several servers", func(t *testing.T) {
+		clear(calls)
+		var logged strings.Builder
+		results := QueryServers([]string{"flaky", "down", "up"}, policy.Wrap(log.New(&logged, "", 0), flaky))
+		summary := []string{}
+		for _, res := range results {
+			summary = append(summary, fmt.Sprintf("%s:%t", res.Server, res.Err == nil))
+		}
+		expected := []string{"flaky:true", "down:false", "up:true"}
+		if !slices.Equal(summary, expected) {
+			t.Fatalf("Wrong results:\nexpected %v,\nrecieved %v", expected, summary)
+		}
+
+		lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+		slices.Sort(lines)
+		expected = []string{
+			"Attempt 1 to down failed: connection refused",
+			"Attempt 1 to flaky failed: timeout",
+			"Attempt 2 to down failed: connection refused",
+			"Attempt 2 to flaky failed: timeout",
+			"Attempt 3 to down failed: connection refused",
+		}
+		if !slices.Equal(lines, expected) {
+			t.Fatalf("Wrong attempts:\nexpected %v,\nrecieved %v", expected, lines)
+		}
+	})
+
+	t.Run("Final failure", func(t *testing.T) {
+		server, resp, _, err := QueryWithFallback([]string{"kod", "down"}, RetryPolicy{}, flaky)
+		var failed QueryFailedError
+		if !errors.As(err, &failed) || len(failed.Attempts) != 2 {
+			t.Fatal("Expected QueryFailedError, got ", err)
+		}
+		// Последний полученный ответ остаётся доступным для диагностики
+		if server != "kod" || resp == nil {
+			t.Fatal("Expected the response of the kod server, got ", server)
+		}
+		if exitCodeFor(err) != exitQueryFailed {
+			t.Fatal("Exit code should be determined by the last error, got ", exitCodeFor(err))
+		}
+	})
+}
+
+func TestAdjust(t *testing.T) {
+	options := AdjustOptions{samples: 3, sampleInterval: time.Millisecond, maxSpread: 50 * time.Millisecond, maxStep: time.Minute, slewThreshold: 128 * time.Millisecond}
+	ms := time.Millisecond
+
+	testCases := []struct {
+		samples []time.Duration
+		offset  time.Duration
+		step    bool
+		err     error
+		hint    string
+	}{
+		{[]time.Duration{10 * ms, 12 * ms, 11 * ms}, 11 * ms, false, nil, "Small offset is slewed"},
+		{[]time.Duration{-2010 * ms, -2000 * ms, -2020 * ms, -2030 * ms}, -2015 * ms, true, nil, "Median of an even number of samples, big offset is stepped"},
+		{[]time.Duration{10 * ms, 90 * ms, 11 * ms}, 11 * ms, false, SamplesDisagreeError{80 * ms, 50 * ms}, "Samples disagree"},
+		{[]time.Duration{2 * time.Minute, 2 * time.Minute}, 2 * time.Minute, true, StepTooLargeError{2 * time.Minute, time.Minute}, "Step is too large"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.hint, func(t *testing.T) {
+			adj, err := PlanAdjustment(tc.samples, options)
+			if err != tc.err {
+				t.Fatalf("Wrong error:\nexpected %v,\nrecieved %v", tc.err, err)
+			}
+			if adj.Offset != tc.offset || adj.Step != tc.step {
+				t.Fatalf("Wrong adjustment:\nexpected %s (step %t),\nrecieved %s (step %t)", tc.offset, tc.step, adj.Offset, adj.Step)
+			}
+		})
+	}
+
+	t.Run("Dry run commands", func(t *testing.T) {
+		now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.Local)
+		step := Adjustment{Offset: 1500 * ms, Step: true}
+		if cmd := step.Command(now); cmd != "timedatectl set-time '2024-03-01 12:00:01.500000'" {
+			t.Fatal("Wrong step command: ", cmd)
+		}
+		slew := Adjustment{Offset: -20 * ms}
+		if cmd := slew.Command(now); cmd != "adjtimex --singleshot -20000" {
+			t.Fatal("Wrong slew command: ", cmd)
+		}
+	})
+
+	t.Run("Measured against a server", func(t *testing.T) {
+		server := startFakeServer(t, 3*time.Second)
+		measure := offsetMeasurer(log.New(io.Discard, "", 0), ntp.Query, RetryPolicy{}, []string{server}, nil)
+		samples, err := MeasureSamples(options, measure)
+		if err != nil || len(samples) != 3 {
+			t.Fatal("Expected 3 samples, got ", samples, err)
+		}
+		adj, err := PlanAdjustment(samples, options)
+		if err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if !adj.Step || (adj.Offset-3*time.Second).Abs() > 50*ms {
+			t.Fatal("Expected a step of about 3s, got ", adj.Offset)
+		}
+
+		var b bytes.Buffer
+		WriteAdjustment(&b, adj, true, time.Now())
+		if !strings.Contains(b.String(), "Would step the clock") || !strings.Contains(b.String(), "timedatectl set-time") {
+			t.Fatal("Wrong dry run output:\n", b.String())
+		}
+	})
+
+	t.Run("Failed sample aborts the measurement", func(t *testing.T) {
+		calls := 0
+		measure := func() (time.Duration, error) {
+			calls++
+			if calls == 2 {
+				return 0, errors.New("timeout")
+			}
+			return 0, nil
+		}
+		if _, err := MeasureSamples(options, measure); err == nil || calls != 2 {
+			t.Fatal("Expected the measurement to stop on the error, calls: ", calls)
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"slices"
+	"time"
+)
+
+var (
+	ErrAlert           = errors.New("Offset or drift exceeded the threshold")
+	ErrNoMeasurements  = errors.New("None of the measurements succeeded")
+	ErrTooManyFailures = errors.New("Too many measurements failed in a row")
+)
+
+type Sample struct {
+	At     time.Time
+	Offset time.Duration
+}
+
+// Кольцевой буфер последних измерений смещения
+type History struct {
+	samples []Sample
+	next    int
+	full    bool
+}
+
+func NewHistory(size int) *History {
+	return &History{samples: make([]Sample, max(size, 2))}
+}
+
+func (h *History) Add(s Sample) {
+	h.samples[h.next] = s
+	h.next = (h.next + 1) % len(h.samples)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+func (h *History) Samples() []Sample {
+	if !h.full {
+		return h.samples[:h.next]
+	}
+	return slices.Concat(h.samples[h.next:], h.samples[:h.next])
+}
+
+// Дрейф локальных часов в ppm по методу наименьших квадратов для зависимости смещения от времени.
+// Положительное значение означает, что локальные часы спешат (смещение относительно сервера уменьшается)
+func (h *History) DriftPPM() (float64, bool) {
+	samples := h.Samples()
+	if len(samples) < 2 {
+		return 0, false
+	}
+
+	start := samples[0].At
+	var sumX, sumY, sumXX, sumXY float64
+	for _, s := range samples {
+		x := s.At.Sub(start).Seconds()
+		y := s.Offset.Seconds()
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, false
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	return -slope * 1e6, true
+}
+
+type WatchOptions struct {
+	interval    time.Duration
+	historySize int
+	// Нулевые пороги не проверяются
+	maxOffset   time.Duration
+	maxDriftPPM float64
+	// Ноль - опрашивать бесконечно
+	count       int
+	exitOnAlert bool
+	// Столько неудачных измерений подряд завершают опрос, ноль - без ограничения
+	maxFailures int
+}
+
+// Периодически измеряет смещение, печатает его и дрейф в out, а при превышении порогов - строку ALERT.
+// При exitOnAlert возвращает ErrAlert на первом же превышении. Если подряд не удались maxFailures измерений,
+// возвращает ErrTooManyFailures, а если из count измерений не удалось ни одно - ErrNoMeasurements
+func Watch(options WatchOptions, measure func() (time.Duration, error), out io.Writer, l *log.Logger) error {
+	history := NewHistory(options.historySize)
+	measured, failures := 0, 0
+	ticker := time.NewTicker(options.interval)
+	defer ticker.Stop()
+
+	for i := 0; options.count == 0 || i < options.count; i++ {
+		if i != 0 {
+			<-ticker.C
+		}
+
+		offset, err := measure()
+		if err != nil {
+			l.Println("Error while measuring the offset: ", err)
+			failures++
+			if options.maxFailures != 0 && failures >= options.maxFailures {
+				return ErrTooManyFailures
+			}
+			continue
+		}
+		measured, failures = measured+1, 0
+		now := time.Now()
+		history.Add(Sample{At: now, Offset: offset})
+
+		drift, hasDrift := history.DriftPPM()
+		if hasDrift {
+			fmt.Fprintf(out, "%s offset=%s drift=%.3fppm\n", now.Format(time.RFC3339), offset, drift)
+		} else {
+			fmt.Fprintf(out, "%s offset=%s\n", now.Format(time.RFC3339), offset)
+		}
+
+		alerted := false
+		if options.maxOffset != 0 && offset.Abs() > options.maxOffset {
+			fmt.Fprintf(out, "ALERT: offset %s exceeds the threshold %s\n", offset, options.maxOffset)
+			alerted = true
+		}
+		if options.maxDriftPPM != 0 && hasDrift && math.Abs(drift) > options.maxDriftPPM {
+			fmt.Fprintf(out, "ALERT: drift %.3fppm exceeds the threshold %.3fppm\n", drift, options.maxDriftPPM)
+			alerted = true
+		}
+		if alerted && options.exitOnAlert {
+			return ErrAlert
+		}
+	}
+	if measured == 0 {
+		return ErrNoMeasurements
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	exitOK = 0
+	// Хотя бы одну строку или файл не удалось обработать
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+const usage = `Использование:
+	dev02 unpack [флаги] [строка ...]
+	dev02 pack [флаги] [строка ...]
+
+Строки из аргументов обрабатываются по отдельности, файлы из -f и STDIN (если нет ни строк, ни файлов) -
+целиком или построчно с -lines. Последний перевод строки файла не считается частью входа.
+pack делит строку на руны, а не на графемы, поэтому -graphemes работает только с unpack.
+
+Флаги:
+`
+
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(path string) error {
+	*f = append(*f, path)
+	return nil
+}
+
+type command struct {
+	pack   bool
+	lines  bool
+	opts   UnpackOptions
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	failed int
+}
+
+func (c *command) process(s string) (string, error) {
+	if c.pack {
+		return Pack(s)
+	}
+	return UnpackWithOptions(s, c.opts)
+}
+
+func (c *command) report(where string, err error) {
+	fmt.Fprintf(c.stderr, "%s: %s\n", where, err)
+	c.failed++
+}
+
+// Каждая строка обрабатывается отдельно, ошибки печатаются с номером строки, а обработка продолжается
+func (c *command) runLines(name string, r io.Reader) {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			c.report(name, err)
+			return
+		}
+		if err == io.EOF && text == "" {
+			return
+		}
+
+		result, processErr := c.process(strings.TrimSuffix(text, "\n"))
+		if processErr != nil {
+			c.report(fmt.Sprintf("%s:%d", name, line), processErr)
+		} else {
+			fmt.Fprintln(c.stdout, result)
+		}
+		if err == io.EOF {
+			return
+		}
+	}
+}
+
+// Распаковка пишется в вывод по мере чтения, упаковке же нужен весь вход
+func (c *command) runWhole(name string, r io.Reader) {
+	var err error
+	if c.pack {
+		var content []byte
+		if content, err = io.ReadAll(r); err == nil {
+			var result string
+			if result, err = Pack(strings.TrimSuffix(string(content), "\n")); err == nil {
+				fmt.Fprintln(c.stdout, result)
+			}
+		}
+	} else if err = UnpackStream(finalNewlineTrimmer{bufio.NewReader(r)}, c.stdout, c.opts); err == nil {
+		fmt.Fprintln(c.stdout)
+	}
+
+	if err != nil {
+		c.report(name, err)
+	}
+}
+
+func (c *command) runFile(path string) {
+	if path == "-" {
+		c.runReader("stdin", c.stdin)
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		c.report(path, err)
+		return
+	}
+	defer file.Close()
+	c.runReader(path, file)
+}
+
+func (c *command) runReader(name string, r io.Reader) {
+	if c.lines {
+		c.runLines(name, r)
+	} else {
+		c.runWhole(name, r)
+	}
+}
+
+// Не отдаёт перевод строки в самом конце потока
+type finalNewlineTrimmer struct {
+	r *bufio.Reader
+}
+
+func (t finalNewlineTrimmer) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n == 0 || p[n-1] != '\n' {
+		return n, err
+	}
+	if _, peekErr := t.r.Peek(1); peekErr == io.EOF {
+		return n - 1, io.EOF
+	}
+	return n, err
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || (args[0] != "unpack" && args[0] != "pack") {
+		fmt.Fprintln(stderr, "Ожидалась команда unpack или pack")
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	c := &command{pack: args[0] == "pack", stdin: stdin, stdout: stdout, stderr: stderr}
+	var files fileList
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.Var(&files, "f", "Файл для обработки, \"-\" - STDIN. Флаг можно повторять")
+	flags.BoolVar(&c.lines, "lines", false, "Обрабатывать каждую строку файлов и STDIN отдельно")
+	flags.Int64Var(&c.opts.MaxOutputSize, "max-output", 0, "Наибольший размер распакованной строки в байтах, 0 - без ограничения")
+	flags.IntVar(&c.opts.MaxRepeat, "max-repeat", 0, "Наибольшее число повторов, 0 - без ограничения")
+	flags.IntVar(&c.opts.MaxDepth, "max-depth", defaultMaxDepth, "Наибольшая вложенность групп")
+	flags.BoolVar(&c.opts.Graphemes, "graphemes", false, "Повторять графему целиком (букву с диакритикой, флаг, эмодзи), а не последнюю руну. Только для unpack")
+	if err := flags.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if c.pack && c.opts.Graphemes {
+		fmt.Fprintln(stderr, "Флаг -graphemes не поддерживается командой pack")
+		return exitUsage
+	}
+	if c.opts.MaxDepth < 0 {
+		fmt.Fprintln(stderr, "Вложенность групп -max-depth не может быть отрицательной")
+		return exitUsage
+	}
+
+	for i, arg := range flags.Args() {
+		result, err := c.process(arg)
+		if err != nil {
+			c.report(fmt.Sprintf("аргумент %d", i+1), err)
+			continue
+		}
+		fmt.Fprintln(stdout, result)
+	}
+	for _, path := range files {
+		c.runFile(path)
+	}
+	if flags.NArg() == 0 && len(files) == 0 {
+		c.runReader("stdin", stdin)
+	}
+
+	if c.failed != 0 {
+		return exitFailed
+	}
+	return exitOK
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Упрощённые правила границ расширенных графем из UAX #29: комбинирующие знаки, ZWJ-последовательности эмодзи,
+// пары региональных индикаторов (флаги) и слоги хангыля из чамо. Префиксы (Prepend) и CR LF не поддерживаются:
+// CR и так можно записать только экранированным
+
+type graphemeClass int
+
+const (
+	otherClass graphemeClass = iota
+	extendClass
+	zwjClass
+	spacingMarkClass
+	regionalIndicatorClass
+	pictographicClass
+	hangulLClass
+	hangulVClass
+	hangulTClass
+	hangulLVClass
+	hangulLVTClass
+)
+
+// Свойство Extended_Pictographic, приближённо: символы, которые на практике бывают эмодзи
+var extendedPictographic = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00A9, 0x00A9, 1}, {0x00AE, 0x00AE, 1}, {0x203C, 0x203C, 1}, {0x2049, 0x2049, 1},
+		{0x2122, 0x2122, 1}, {0x2139, 0x2139, 1}, {0x2194, 0x2199, 1}, {0x21A9, 0x21AA, 1},
+		{0x231A, 0x231B, 1}, {0x2328, 0x2328, 1}, {0x23CF, 0x23CF, 1}, {0x23E9, 0x23F3, 1},
+		{0x23F8, 0x23FA, 1}, {0x24C2, 0x24C2, 1}, {0x25AA, 0x25AB, 1}, {0x25B6, 0x25B6, 1},
+		{0x25C0, 0x25C0, 1}, {0x25FB, 0x25FE, 1}, {0x2600, 0x27BF, 1}, {0x2934, 0x2935, 1},
+		{0x2B05, 0x2B07, 1}, {0x2B1B, 0x2B1C, 1}, {0x2B50, 0x2B50, 1}, {0x2B55, 0x2B55, 1},
+		{0x3030, 0x3030, 1}, {0x303D, 0x303D, 1}, {0x3297, 0x3297, 1}, {0x3299, 0x3299, 1},
+	},
+	R32: []unicode.Range32{
+		{0x1F000, 0x1FAFF, 1}, {0x1FC00, 0x1FFFD, 1},
+	},
+}
+
+func classify(r rune) graphemeClass {
+	switch {
+	case r == '\u200D':
+		return zwjClass
+	// Модификаторы цвета кожи, теги флагов регионов и ZWNJ тоже продолжают графему
+	case unicode.In(r, unicode.Mn, unicode.Me) || r >= 0x1F3FB && r <= 0x1F3FF || r >= 0xE0020 && r <= 0xE007F || r == '\u200C':
+		return extendClass
+	case unicode.Is(unicode.Mc, r):
+		return spacingMarkClass
+	case r >= 0x1F1E6 && r <= 0x1F1FF:
+		return regionalIndicatorClass
+	case unicode.Is(extendedPictographic, r):
+		return pictographicClass
+	case r >= 0x1100 && r <= 0x115F || r >= 0xA960 && r <= 0xA97C:
+		return hangulLClass
+	case r >= 0x1160 && r <= 0x11A7 || r >= 0xD7B0 && r <= 0xD7C6:
+		return hangulVClass
+	case r >= 0x11A8 && r <= 0x11FF || r >= 0xD7CB && r <= 0xD7FB:
+		return hangulTClass
+	case r >= 0xAC00 && r <= 0xD7A3:
+		if (r-0xAC00)%28 == 0 {
+			return hangulLVClass
+		}
+		return hangulLVTClass
+	}
+	return otherClass
+}
+
+// Состояние текущей графемы, достаточное, чтобы решить, продолжает ли её следующая руна
+type graphemeState struct {
+	active bool
+	last   graphemeClass
+	// Число региональных индикаторов подряд: флаг - это ровно два индикатора
+	regionalIndicators int
+	// Графема - эмодзи с возможными Extend после него (правило GB11)
+	pictographic bool
+}
+
+func (g *graphemeState) reset() {
+	*g = graphemeState{}
+}
+
+func (g *graphemeState) start(r rune) {
+	g.reset()
+	g.active = true
+	g.add(r)
+}
+
+func (g *graphemeState) continues(r rune) bool {
+	if !g.active {
+		return false
+	}
+	class := classify(r)
+	switch {
+	case class == extendClass || class == zwjClass || class == spacingMarkClass:
+		return true
+	case g.last == hangulLClass:
+		return class == hangulLClass || class == hangulVClass || class == hangulLVClass || class == hangulLVTClass
+	case g.last == hangulLVClass || g.last == hangulVClass:
+		return class == hangulVClass || class == hangulTClass
+	case g.last == hangulLVTClass || g.last == hangulTClass:
+		return class == hangulTClass
+	case g.last == zwjClass:
+		return g.pictographic && class == pictographicClass
+	case g.last == regionalIndicatorClass:
+		return class == regionalIndicatorClass && g.regionalIndicators%2 == 1
+	}
+	return false
+}
+
+func (g *graphemeState) add(r rune) {
+	class := classify(r)
+	switch class {
+	case pictographicClass:
+		g.pictographic = true
+	case extendClass, zwjClass:
+	default:
+		g.pictographic = false
+	}
+	if class == regionalIndicatorClass {
+		g.regionalIndicators++
+	} else {
+		g.regionalIndicators = 0
+	}
+	g.last = class
+}
+
+// Длина начала s, продолжающего текущую графему
+func (g *graphemeState) extent(s string) int {
+	n := 0
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !g.continues(r) {
+			break
+		}
+		g.add(r)
+		n += size
+	}
+	return n
+}
+
+// Графема начинается с символа или escape-последовательности, а числа и группы её обрывают
+func (g *graphemeState) follow(tokenType int, tokenStr string) {
+	switch tokenType {
+	case charToken:
+		r, _ := utf8.DecodeRuneInString(tokenStr)
+		g.start(r)
+	case escapeToken:
+		r, _ := utf8.DecodeRuneInString(decodeEscape(tokenStr))
+		g.start(r)
+	case extendToken:
+	default:
+		g.reset()
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type UnpackableRuneError struct {
+	Offset int
+}
+
+func (err UnpackableRuneError) Error() string {
+	return fmt.Sprintf("Invalid utf8 at byte %d can't be packed", err.Offset)
+}
+
+var escapedRunes = map[rune]string{'\\': `\\`, '(': `\(`, ')': `\)`, '\n': `\n`, '\t': `\t`, '\r': `\r`}
+
+// Запись одной руны в том виде, в каком её прочитает parseToken: цифры и особые руны экранируются,
+// иначе они бы читались как число или группа. Непечатаемые руны записываются как \u{XXXX},
+// чтобы упакованная строка оставалась одной строкой текста
+func encodeRune(r rune) string {
+	switch {
+	case escapedRunes[r] != "":
+		return escapedRunes[r]
+	case unicode.IsDigit(r):
+		return `\` + string(r)
+	case !unicode.IsPrint(r) || r == utf8.RuneError:
+		return fmt.Sprintf(`\u{%X}`, r)
+	}
+	return string(r)
+}
+
+// Обратная к Unpack функция: Unpack(Pack(s)) == s для любой строки в utf8.
+// Каждая серия одинаковых рун записывается самым коротким способом - либо повторением,
+// либо руной с числом (при равной длине - числом, как в "a4bc2d5e"). Группы не используются,
+// так что самой короткой запись получается только среди записей без групп
+func Pack(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			return "", UnpackableRuneError{Offset: i}
+		}
+
+		count := 1
+		for i+count*size < len(s) && strings.HasPrefix(s[i+count*size:], s[i:i+size]) {
+			count++
+		}
+		i += count * size
+
+		token := encodeRune(r)
+		repeated := strconv.Itoa(count)
+		if count == 1 || count*len(token) < len(token)+len(repeated) {
+			b.WriteString(strings.Repeat(token, count))
+		} else {
+			b.WriteString(token + repeated)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type UnpackOptions struct {
+	// Нулевые пределы не проверяются
+	MaxOutputSize int64
+	MaxRepeat     int
+	// Наибольшая вложенность групп, ноль или меньше - defaultMaxDepth
+	MaxDepth int
+	// Повторять расширенные графемы (букву с диакритикой, флаг, эмодзи с ZWJ) целиком, а не последнюю руну.
+	// Графему продолжают только руны, записанные как есть, а не экранированные
+	Graphemes bool
+}
+
+const defaultMaxDepth = 64
+
+func (opts UnpackOptions) maxDepth() int {
+	if opts.MaxDepth <= 0 {
+		return defaultMaxDepth
+	}
+	return opts.MaxDepth
+}
+
+type OutputLimitError struct {
+	Limit int64
+}
+
+func (err OutputLimitError) Error() string {
+	return fmt.Sprintf("Unpacked string exceeds the limit of %d bytes", err.Limit)
+}
+
+type RepeatLimitError struct {
+	Count int
+	Limit int
+}
+
+func (err RepeatLimitError) Error() string {
+	return fmt.Sprintf("Repeat count %d exceeds the limit of %d", err.Count, err.Limit)
+}
+
+// В окно гарантированно помещается любой токен, кроме числа: самый длинный из них - \u{10FFFF}
+const tokenWindow = 16
+
+// Позиция токена: смещение в байтах и число рун перед ним
+type position struct {
+	offset, column int
+}
+
+func (p *position) advance(consumed string) {
+	p.offset += len(consumed)
+	p.column += utf8.RuneCountInString(consumed)
+}
+
+// Источник токенов, в конце возвращает io.EOF. Ошибки разбора возвращаются как UnpackError,
+// а last - позиция последнего прочитанного токена
+type tokenSource interface {
+	next() (int, string, error)
+	last() position
+}
+
+type stringTokens struct {
+	s          string
+	cur, start position
+	graphemes  bool
+	grapheme   graphemeState
+}
+
+func (st *stringTokens) next() (int, string, error) {
+	st.start = st.cur
+	rest := st.s[st.cur.offset:]
+	if len(rest) == 0 {
+		return 0, "", io.EOF
+	}
+	if n := st.grapheme.extent(rest); n != 0 {
+		st.cur.advance(rest[:n])
+		return extendToken, rest[:n], nil
+	}
+
+	tokenType, tokenStr, err := parseToken(rest)
+	if err != nil {
+		return 0, "", newUnpackError(st.start, badToken(rest), err)
+	}
+	st.cur.advance(rest[:tokenLen(tokenType, tokenStr)])
+	if st.graphemes {
+		st.grapheme.follow(tokenType, tokenStr)
+	}
+	return tokenType, tokenStr, nil
+}
+
+func (st *stringTokens) last() position {
+	return st.start
+}
+
+// Читает токены потока тем же parseToken, что разбирает строку целиком.
+// Число может не поместиться в окно, поэтому его цифры накапливаются, пока не встретится другой токен
+type tokenReader struct {
+	r          *bufio.Reader
+	cur, start position
+	graphemes  bool
+	grapheme   graphemeState
+}
+
+func (tr *tokenReader) next() (int, string, error) {
+	tr.start = tr.cur
+	digits := ""
+	for {
+		buf, peekErr := tr.r.Peek(tokenWindow)
+		if peekErr != nil && peekErr != io.EOF {
+			return 0, "", peekErr
+		}
+		if len(buf) == 0 {
+			if digits != "" {
+				return numToken, digits, nil
+			}
+			return 0, "", io.EOF
+		}
+		// Длинная графема читается по частям, состояние между ними сохраняется в tr.grapheme
+		if tr.grapheme.active {
+			if n := tr.grapheme.extent(string(buf)); n != 0 {
+				extension := string(buf[:n])
+				tr.cur.advance(extension)
+				tr.r.Discard(n)
+				return extendToken, extension, nil
+			}
+		}
+
+		tokenType, tokenStr, err := parseToken(string(buf))
+		if digits != "" && (err != nil || tokenType != numToken) {
+			return numToken, digits, nil
+		}
+		if err != nil {
+			return 0, "", newUnpackError(tr.start, badToken(string(buf)), err)
+		}
+
+		consumed := tokenLen(tokenType, tokenStr)
+		tr.cur.advance(string(buf[:consumed]))
+		tr.r.Discard(consumed)
+		if tr.graphemes {
+			tr.grapheme.follow(tokenType, tokenStr)
+		}
+		if tokenType != numToken {
+			return tokenType, tokenStr, nil
+		}
+
+		digits += tokenStr
+		// Последняя цифра в окне могла оказаться обрезанной руной
+		if peekErr == io.EOF || len(tokenStr) <= len(buf)-utf8.UTFMax {
+			return numToken, digits, nil
+		}
+	}
+}
+
+func (tr *tokenReader) last() position {
+	return tr.start
+}
+
+// Длина записи токена во входной строке
+func tokenLen(tokenType int, tokenStr string) int {
+	if tokenType == escapeToken {
+		return len("\\") + len(tokenStr)
+	}
+	return len(tokenStr)
+}
+
+// Руна, на которой остановился разбор, а для обратного слеша - вместе со следующей за ним
+func badToken(s string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	_, size := utf8.DecodeRuneInString(s)
+	if s[0] == '\\' {
+		_, next := utf8.DecodeRuneInString(s[size:])
+		size += next
+	}
+	return s[:size]
+}
+
+type limitedWriter struct {
+	w       io.StringWriter
+	written int64
+	limit   int64
+}
+
+func (lw *limitedWriter) repeat(s string, count int) error {
+	if lw.limit != 0 && len(s) != 0 && int64(count) > (lw.limit-lw.written)/int64(len(s)) {
+		return OutputLimitError{lw.limit}
+	}
+	for range count {
+		if _, err := lw.w.WriteString(s); err != nil {
+			return err
+		}
+	}
+	lw.written += int64(len(s)) * int64(count)
+	return nil
+}
+
+// Распаковывает поток по токену, не собирая результат в памяти.
+// При ошибке в w остаётся всё, что успело распаковаться до неё
+func UnpackStream(r io.Reader, w io.Writer, opts UnpackOptions) error {
+	buffered := bufio.NewWriter(w)
+	err := unpackTokens(&tokenReader{r: bufio.NewReader(r), graphemes: opts.Graphemes}, &limitedWriter{w: buffered, limit: opts.MaxOutputSize}, opts, 0, position{})
+	if flushErr := buffered.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// Ошибки записи в w возвращаются как есть, а превышение лимита относится к позиции токена
+func wrapLimitError(pos position, token string, err error) error {
+	if limitErr, ok := err.(OutputLimitError); ok {
+		return newUnpackError(pos, token, limitErr)
+	}
+	return err
+}
+
+// Распаковывает токены до конца группы, открытой в позиции open, а на нулевой глубине - до конца входа.
+// Число повторов идёт после группы, поэтому её содержимое собирается в памяти
+func unpackTokens(tokens tokenSource, out *limitedWriter, opts UnpackOptions, depth int, open position) error {
+	prevTokenStr := ""
+	for {
+		tokenType, tokenStr, err := tokens.next()
+		if err == io.EOF {
+			if depth != 0 {
+				return newUnpackError(open, "(", UnbalancedGroupError{})
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch tokenType {
+		case groupEndToken:
+			if depth == 0 {
+				return newUnpackError(tokens.last(), tokenStr, UnbalancedGroupError{})
+			}
+			return nil
+		case groupStartToken:
+			if depth >= opts.maxDepth() {
+				return newUnpackError(tokens.last(), tokenStr, DepthLimitError{opts.maxDepth()})
+			}
+			// Содержимое группы учитывается в общем лимите размера
+			var group strings.Builder
+			inner := &limitedWriter{w: &group, written: out.written, limit: out.limit}
+			if err := unpackTokens(tokens, inner, opts, depth+1, tokens.last()); err != nil {
+				return err
+			}
+			tokenStr = group.String()
+		case escapeToken:
+			tokenStr = decodeEscape(tokenStr)
+		case extendToken:
+			if err := out.repeat(tokenStr, 1); err != nil {
+				return wrapLimitError(tokens.last(), tokenStr, err)
+			}
+			prevTokenStr += tokenStr
+			continue
+		case numToken:
+			numRepeat, err := strconv.Atoi(tokenStr)
+			if err != nil {
+				return newUnpackError(tokens.last(), tokenStr, err)
+			}
+			if prevTokenStr == "" {
+				return newUnpackError(tokens.last(), tokenStr, BadNumTokenError{})
+			}
+			if opts.MaxRepeat != 0 && numRepeat > opts.MaxRepeat {
+				return newUnpackError(tokens.last(), tokenStr, RepeatLimitError{Count: numRepeat, Limit: opts.MaxRepeat})
+			}
+			if err := out.repeat(prevTokenStr, max(numRepeat-1, 0)); err != nil {
+				return wrapLimitError(tokens.last(), tokenStr, err)
+			}
+			continue
+		}
+
+		if err := out.repeat(tokenStr, 1); err != nil {
+			return wrapLimitError(tokens.last(), tokenStr, err)
+		}
+		prevTokenStr = tokenStr
+	}
+}
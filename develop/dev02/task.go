@@ -1,9 +1,10 @@
 package main
 
 import (
-	// "fmt"
-	// "bytes"
+	"fmt"
+	"os"
 	"strconv"
+	// "bytes"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -30,6 +31,11 @@ import (
 const numToken = 0
 const charToken = 1
 const escapeToken = 2
+const groupStartToken = 3
+const groupEndToken = 4
+
+// Руны, продолжающие графему предыдущего токена, в режиме UnpackOptions.Graphemes
+const extendToken = 5
 
 type EmptyTokenError struct{}
 
@@ -49,6 +55,95 @@ func (err BadNumTokenError) Error() string {
 	return "Can't repeat an empty string"
 }
 
+type BadEscapeError struct{}
+
+func (err BadEscapeError) Error() string {
+	return "Malformed escape sequence, expected \\u{XXXX} with up to 6 hex digits of a valid code point"
+}
+
+type UnbalancedGroupError struct{}
+
+func (err UnbalancedGroupError) Error() string {
+	return "Unbalanced group parentheses"
+}
+
+type DepthLimitError struct {
+	Limit int
+}
+
+func (err DepthLimitError) Error() string {
+	return fmt.Sprintf("Groups are nested deeper than %d", err.Limit)
+}
+
+type ErrorKind int
+
+const (
+	KindEmptyToken ErrorKind = iota
+	KindBadToken
+	KindBadNumToken
+	KindBadCount
+	KindOutputLimit
+	KindRepeatLimit
+	KindBadEscape
+	KindUnbalancedGroup
+	KindDepthLimit
+)
+
+var errorKindNames = []string{
+	"empty token", "bad token", "bad number token", "bad repeat count", "output limit", "repeat limit",
+	"bad escape", "unbalanced group", "depth limit",
+}
+
+func (kind ErrorKind) String() string {
+	if kind < 0 || int(kind) >= len(errorKindNames) {
+		return fmt.Sprintf("ErrorKind(%d)", kind)
+	}
+	return errorKindNames[kind]
+}
+
+// Ошибка с местом во входной строке, чтобы её можно было подчеркнуть.
+// Исходная ошибка (EmptyTokenError, BadTokenError и т.д.) доступна через errors.Is и errors.As
+type UnpackError struct {
+	// Смещение в байтах от начала строки
+	Offset int
+	// Номер руны, начиная с 1
+	Column int
+	Token  string
+	Kind   ErrorKind
+	Err    error
+}
+
+func (err UnpackError) Error() string {
+	return fmt.Sprintf("Column %d (byte %d), token %q: %s", err.Column, err.Offset, err.Token, err.Err)
+}
+
+func (err UnpackError) Unwrap() error {
+	return err.Err
+}
+
+func newUnpackError(pos position, token string, err error) UnpackError {
+	kind := KindBadCount
+	switch err.(type) {
+	case EmptyTokenError:
+		kind = KindEmptyToken
+	case BadTokenError:
+		kind = KindBadToken
+	case BadNumTokenError:
+		kind = KindBadNumToken
+	case OutputLimitError:
+		kind = KindOutputLimit
+	case RepeatLimitError:
+		kind = KindRepeatLimit
+	case BadEscapeError:
+		kind = KindBadEscape
+	case UnbalancedGroupError:
+		kind = KindUnbalancedGroup
+	case DepthLimitError:
+		kind = KindDepthLimit
+	}
+	return UnpackError{Offset: pos.offset, Column: pos.column + 1, Token: token, Kind: kind, Err: err}
+}
+
 func parseNum(s string) int {
 	for i, char := range s {
 		if !unicode.IsDigit(char) {
@@ -58,6 +153,37 @@ func parseNum(s string) int {
 	return len(s)
 }
 
+// Длина escape-последовательности \u{XXXX} без обратного слеша
+func parseCodePoint(s string) (int, error) {
+	end := strings.IndexByte(s[:min(len(s), len("u{10FFFF}"))], '}')
+	if !strings.HasPrefix(s, "u{") || end < len("u{")+1 || end > len("u{")+6 {
+		return 0, BadEscapeError{}
+	}
+	code, err := strconv.ParseUint(s[len("u{"):end], 16, 32)
+	if err != nil || code > unicode.MaxRune || (code >= 0xD800 && code <= 0xDFFF) {
+		return 0, BadEscapeError{}
+	}
+	return end + 1, nil
+}
+
+// Значение escape-последовательности, разобранной parseToken. Кроме \n, \t, \r и \u{XXXX}
+// обратный слеш просто отменяет особый смысл следующей руны
+func decodeEscape(tokenStr string) string {
+	switch tokenStr {
+	case "n":
+		return "\n"
+	case "t":
+		return "\t"
+	case "r":
+		return "\r"
+	}
+	if strings.HasPrefix(tokenStr, "u{") {
+		code, _ := strconv.ParseUint(tokenStr[len("u{"):len(tokenStr)-1], 16, 32)
+		return string(rune(code))
+	}
+	return tokenStr
+}
+
 func parseToken(s string) (int, string, error) {
 	if len(s) == 0 {
 		return 0, "", EmptyTokenError{}
@@ -78,7 +204,18 @@ func parseToken(s string) (int, string, error) {
 		if secondChar == utf8.RuneError {
 			return 0, "", BadTokenError{}
 		}
+		if secondChar == 'u' {
+			escapeSize, err := parseCodePoint(s[size:])
+			if err != nil {
+				return 0, "", err
+			}
+			return escapeToken, s[size : size+escapeSize], nil
+		}
 		return escapeToken, s[size : secondSize+size], nil
+	case firstChar == '(':
+		return groupStartToken, s[:size], nil
+	case firstChar == ')':
+		return groupEndToken, s[:size], nil
 	case unicode.IsDigit(firstChar):
 		numEnd := parseNum(s)
 		return numToken, s[:numEnd], nil
@@ -88,44 +225,17 @@ func parseToken(s string) (int, string, error) {
 }
 
 func Unpack(s string) (string, error) {
-	tokenEnd := 0
-	prevTokenStr := ""
-	var b strings.Builder
-
-	for tokenEnd <= len(s)-1 {
-		tokenType, tokenStr, err := parseToken(s[tokenEnd:])
-		tokenEnd += len(tokenStr)
-		if tokenType == escapeToken {
-			tokenEnd += len("\\")
-		}
-		// fmt.Println(tokenType, tokenStr, tokenEnd, len(s)-1, tokenEnd < len(s)-1)
-
-		if err != nil {
-			return "", err
-		}
-
-		if tokenType == numToken {
-			numRepeat, err := strconv.Atoi(tokenStr)
-			if err != nil {
-				return "", err
-			}
-
-			if prevTokenStr == "" {
-				return "", BadNumTokenError{}
-			}
+	return UnpackWithOptions(s, UnpackOptions{})
+}
 
-			for _ = range numRepeat - 1 {
-				b.WriteString(prevTokenStr)
-			}
-		} else {
-			b.WriteString(tokenStr)
-			prevTokenStr = tokenStr
-		}
+func UnpackWithOptions(s string, opts UnpackOptions) (string, error) {
+	var b strings.Builder
+	if err := unpackTokens(&stringTokens{s: s, graphemes: opts.Graphemes}, &limitedWriter{w: &b, limit: opts.MaxOutputSize}, opts, 0, position{}); err != nil {
+		return "", err
 	}
-
 	return b.String(), nil
 }
 
 func main() {
-
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
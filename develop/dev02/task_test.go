@@ -1,7 +1,14 @@
 package main
 
 import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"unicode/utf8"
 )
 
 type testCase struct {
@@ -60,3 +67,413 @@ func BenchmarkUnpack(b *testing.B) {
 		Unpack(input)
 	}
 }
+
+func TestPack(t *testing.T) {
+	testCases := []testCase{
+		{"abcd", "abcd", "Plain string"},
+		{"aaaabccddddde", "a4bc2d5e", "Simple packing"},
+		{"", "", "Empty string"},
+		{"aab", "a2b", "Number is preferred for a doubled rune"},
+		{"qwe45", `qwe\4\5`, "Digits are escaped"},
+		{"qwe44444", `qwe\45`, "Repeated digit"},
+		{`qwe\\\\\`, `qwe\\5`, "Repeated backslash"},
+		{"\\\\", `\\2`, "Doubled backslash"},
+		{"ффффффффффф", "ф11", "Multi-digit count of a multibyte rune"},
+		{"a\nb\t\t\t\x00", `a\nb\t3\u{0}`, "Non-printable runes are escaped"},
+		{"(ab)", `\(ab\)`, "Parentheses are escaped"},
+		{"a�", `a\u{FFFD}`, "Replacement character"},
+		{"٣٣٣", "\\٣3", "Non-ASCII digits are escaped"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			testOutput, err := Pack(test.input)
+			if err != nil {
+				t.Fatal("Error while packing: ", err)
+			}
+
+			if testOutput != test.output {
+				t.Fatalf("Wrong output:\nexpected %s,\nrecieved %s", test.output, testOutput)
+			}
+		})
+	}
+
+	errCases := []testCase{
+		{"ab\xffc", "", "Invalid utf8"},
+	}
+
+	for _, test := range errCases {
+		t.Run(test.hint, func(t *testing.T) {
+			testOutput, err := Pack(test.input)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+
+			if testOutput != test.output {
+				t.Fatalf("Wrong output:\nexpected %s,\nrecieved %s", test.output, testOutput)
+			}
+		})
+	}
+}
+
+func FuzzPack(f *testing.F) {
+	for _, seed := range []string{"", "abcd", "aaaabccddddde", "qwe45", `qwe\\\\\`, "a\nb\t\t\t", "ффф٣٣", "\x00\x00\x00", "(a)3", "\\u{1F600}"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		packed, err := Pack(s)
+		if err != nil {
+			if utf8.ValidString(s) {
+				t.Fatalf("Unexpected error while packing %q: %s", s, err)
+			}
+			return
+		}
+
+		unpacked, err := Unpack(packed)
+		if err != nil {
+			t.Fatalf("Error while unpacking %q packed from %q: %s", packed, s, err)
+		}
+		if unpacked != s {
+			t.Fatalf("Round trip failed:\nexpected %q,\nrecieved %q (packed %q)", s, unpacked, packed)
+		}
+		if len(packed) > 6*len(s) {
+			t.Fatalf("Packed %q is more than 6 times as long as %q", packed, s)
+		}
+	})
+}
+
+func TestUnpackStream(t *testing.T) {
+	testCases := []testCase{
+		{"a4bc2d5e", "aaaabccddddde", "Simple unpacking"},
+		{`qwe\45`, "qwe44444", "Repeat an escape sequence"},
+		{"ф12", "фффффффффффф", "Number split between reads"},
+		{"x" + strings.Repeat("0", 20) + "3", "xxx", "Number longer than the read window"},
+		{"я٣", "", "Non-ASCII digit split between reads"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			var b strings.Builder
+			// По байту за чтение, чтобы токены разрывались на границах
+			err := UnpackStream(iotest.OneByteReader(strings.NewReader(test.input)), &b, UnpackOptions{})
+			expected, expectedErr := Unpack(test.input)
+			if (err == nil) != (expectedErr == nil) {
+				t.Fatalf("Stream and string errors differ: %v and %v", err, expectedErr)
+			}
+			if err == nil && (b.String() != test.output || b.String() != expected) {
+				t.Fatalf("Wrong output:\nexpected %s,\nrecieved %s", test.output, b.String())
+			}
+		})
+	}
+
+	t.Run("Output size limit", func(t *testing.T) {
+		var b strings.Builder
+		err := UnpackStream(strings.NewReader("ab999999999"), &b, UnpackOptions{MaxOutputSize: 1 << 20})
+		var limitErr OutputLimitError
+		if !errors.As(err, &limitErr) || limitErr.Limit != 1<<20 {
+			t.Fatal("Expected OutputLimitError, got ", err)
+		}
+		// Всё, что было до превышения, уже записано
+		if b.String() != "ab" {
+			t.Fatalf("Wrong output:\nexpected %s,\nrecieved %s", "ab", b.String())
+		}
+	})
+
+	t.Run("Output fits the limit exactly", func(t *testing.T) {
+		var b strings.Builder
+		if err := UnpackStream(strings.NewReader("ab3"), &b, UnpackOptions{MaxOutputSize: 4}); err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	})
+
+	t.Run("Repeat count limit", func(t *testing.T) {
+		err := UnpackStream(strings.NewReader("a10b11"), io.Discard, UnpackOptions{MaxRepeat: 10})
+		var limitErr RepeatLimitError
+		if !errors.As(err, &limitErr) || limitErr.Count != 11 {
+			t.Fatal("Expected RepeatLimitError, got ", err)
+		}
+	})
+
+	t.Run("Big output is written incrementally", func(t *testing.T) {
+		counter := &countingWriter{}
+		if err := UnpackStream(strings.NewReader("a10000000"), counter, UnpackOptions{}); err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if counter.n != 10000000 || counter.maxWrite > 64*1024 {
+			t.Fatalf("Expected small writes of 10000000 bytes in total, got %d bytes, the biggest write %d", counter.n, counter.maxWrite)
+		}
+	})
+}
+
+type countingWriter struct {
+	n, maxWrite int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	w.maxWrite = max(w.maxWrite, len(p))
+	return len(p), nil
+}
+
+func TestUnpackError(t *testing.T) {
+	testCases := []struct {
+		input  string
+		offset int
+		column int
+		token  string
+		kind   ErrorKind
+		target error
+		hint   string
+	}{
+		{"45", 0, 1, "45", KindBadNumToken, BadNumTokenError{}, "Number at the start"},
+		{"ab\x01c", 2, 3, "\x01", KindBadToken, BadTokenError{}, "Non-printable rune"},
+		{"фф\xffc", 4, 3, "\xff", KindBadToken, BadTokenError{}, "Invalid utf8 after multibyte runes"},
+		{`ффф\`, 6, 4, `\`, KindBadToken, BadTokenError{}, "Escape sequence on nothing"},
+		{"a2b99999999999999999999", 3, 4, "99999999999999999999", KindBadCount, nil, "Repeat count overflows"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			check := func(err error) {
+				var unpackErr UnpackError
+				if !errors.As(err, &unpackErr) {
+					t.Fatal("Expected UnpackError, got ", err)
+				}
+				if unpackErr.Offset != test.offset || unpackErr.Column != test.column || unpackErr.Token != test.token || unpackErr.Kind != test.kind {
+					t.Fatalf("Wrong error:\nexpected byte %d, column %d, token %q, %s,\nrecieved byte %d, column %d, token %q, %s",
+						test.offset, test.column, test.token, test.kind, unpackErr.Offset, unpackErr.Column, unpackErr.Token, unpackErr.Kind)
+				}
+				if test.target != nil && !errors.Is(err, test.target) {
+					t.Fatalf("Expected the error to be %T", test.target)
+				}
+			}
+
+			_, err := Unpack(test.input)
+			check(err)
+			check(UnpackStream(iotest.OneByteReader(strings.NewReader(test.input)), io.Discard, UnpackOptions{}))
+		})
+	}
+
+	t.Run("Limits", func(t *testing.T) {
+		err := UnpackStream(strings.NewReader("ab9999"), io.Discard, UnpackOptions{MaxRepeat: 100})
+		var unpackErr UnpackError
+		var limitErr RepeatLimitError
+		if !errors.As(err, &unpackErr) || unpackErr.Column != 3 || unpackErr.Kind != KindRepeatLimit || !errors.As(err, &limitErr) {
+			t.Fatal("Expected a repeat limit error at column 3, got ", err)
+		}
+
+		err = UnpackStream(strings.NewReader("abcd"), io.Discard, UnpackOptions{MaxOutputSize: 2})
+		if !errors.As(err, &unpackErr) || unpackErr.Column != 3 || unpackErr.Token != "c" || unpackErr.Kind != KindOutputLimit {
+			t.Fatal("Expected an output limit error at column 3, got ", err)
+		}
+	})
+
+	t.Run("Kind names", func(t *testing.T) {
+		for kind, expected := range map[ErrorKind]string{KindBadCount: "bad repeat count", KindDepthLimit: "depth limit", -1: "ErrorKind(-1)", 100: "ErrorKind(100)"} {
+			if kind.String() != expected {
+				t.Fatalf("Wrong name:\nexpected %q,\nrecieved %q", expected, kind.String())
+			}
+		}
+	})
+}
+
+func TestCLI(t *testing.T) {
+	dir := t.TempDir()
+	packedFile := filepath.Join(dir, "packed.txt")
+	if err := os.WriteFile(packedFile, []byte("a4bc2d5e\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		args   []string
+		stdin  string
+		stdout string
+		stderr string
+		code   int
+		hint   string
+	}{
+		{[]string{"unpack", "a4bc2d5e", `qwe\45`}, "", "aaaabccddddde\nqwe44444\n", "", exitOK, "Arguments"},
+		{[]string{"pack", "aaaabccddddde", "qwe44444"}, "", "a4bc2d5e\nqwe\\45\n", "", exitOK, "Pack arguments"},
+		{[]string{"unpack", "a2", "45", "b3"}, "", "aa\nbbb\n", "аргумент 2: ", exitFailed, "Bad argument"},
+		{[]string{"unpack"}, "a3", "aaa\n", "", exitOK, "Whole stdin"},
+		{[]string{"unpack", "-lines"}, "a2\n45\nb3\nc", "aa\nbbb\nc\n", "stdin:2: ", exitFailed, "Lines with errors"},
+		{[]string{"pack", "-lines"}, "aaa\nbb\n", "a3\nb2\n", "", exitOK, "Pack lines"},
+		{[]string{"unpack", "-f", packedFile, "-f", "-"}, "b2", "aaaabccddddde\nbb\n", "", exitOK, "File and stdin"},
+		{[]string{"unpack", "-f", filepath.Join(dir, "missing")}, "", "", "missing: ", exitFailed, "Missing file"},
+		{[]string{"unpack", "-max-repeat", "5", "a6"}, "", "", "аргумент 1: ", exitFailed, "Repeat limit"},
+		{[]string{"compress"}, "", "", "unpack или pack", exitUsage, "Unknown command"},
+		{[]string{"pack", "-graphemes", "aaa"}, "", "", "-graphemes", exitUsage, "Pack doesn't split graphemes"},
+		{[]string{"unpack", "-max-depth", "-1", "a2"}, "", "", "-max-depth", exitUsage, "Negative depth limit"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			code := run(test.args, strings.NewReader(test.stdin), &stdout, &stderr)
+			if code != test.code {
+				t.Fatalf("Wrong exit code:\nexpected %d,\nrecieved %d\n%s", test.code, code, stderr.String())
+			}
+			if stdout.String() != test.stdout {
+				t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q", test.stdout, stdout.String())
+			}
+			if !strings.Contains(stderr.String(), test.stderr) {
+				t.Fatalf("Wrong errors:\nexpected %q,\nrecieved %q", test.stderr, stderr.String())
+			}
+		})
+	}
+}
+
+// Грамматика упакованной строки:
+//
+//	string  = { item [ count ] }
+//	item    = rune | escape | group
+//	group   = "(" string ")"
+//	escape  = "\" ( "n" | "t" | "r" | "u{" hex{1,6} "}" | rune )
+//	count   = digit { digit }
+//
+// rune - печатаемая руна, кроме цифр, "\", "(" и ")". Число повторяет предыдущий элемент,
+// в том числе группу целиком, 0 оставляет его один раз. Вложенность групп ограничена UnpackOptions.MaxDepth
+func TestGroupsAndEscapes(t *testing.T) {
+	testCases := []testCase{
+		{"(ab)3", "ababab", "Grouped repeat"},
+		{"(ab)", "ab", "Group without a count"},
+		{"x(a2b)2y", "xaabaaby", "Count inside a group"},
+		{"((ab)2c)2", "ababcababc", "Nested groups"},
+		{"(a(b(c)2)2)2", "abccbccabccbcc", "Deeply nested groups"},
+		{"()", "", "Empty group"},
+		{`\(a\)3`, "(a)))", "Escaped parentheses"},
+		{`a\nb\t2\r`, "a\nb\t\t\r", "Standard escapes"},
+		{`\u{1F600}3`, "😀😀😀", "Code point escape"},
+		{`\u{41}\u{0}`, "A\x00", "Short code points"},
+		{`\a\b`, "ab", "Other escaped letters stay as they are"},
+		{`(\u{1F600}\n)2`, "😀\n😀\n", "Escapes inside a group"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			testOutput, err := Unpack(test.input)
+			if err != nil {
+				t.Fatal("Error while unpacking: ", err)
+			}
+
+			if testOutput != test.output {
+				t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q", test.output, testOutput)
+			}
+
+			var b strings.Builder
+			if err := UnpackStream(iotest.OneByteReader(strings.NewReader(test.input)), &b, UnpackOptions{}); err != nil || b.String() != test.output {
+				t.Fatalf("Wrong stream output:\nexpected %q,\nrecieved %q, %v", test.output, b.String(), err)
+			}
+		})
+	}
+
+	errCases := []struct {
+		input  string
+		column int
+		kind   ErrorKind
+		hint   string
+	}{
+		{"a(bc", 2, KindUnbalancedGroup, "Unclosed group"},
+		{"ab)c", 3, KindUnbalancedGroup, "Unexpected closing parenthesis"},
+		{"a()3", 4, KindBadNumToken, "Repeat an empty group"},
+		{`a\u1F600`, 2, KindBadEscape, "Code point without braces"},
+		{`a\u{}`, 2, KindBadEscape, "Empty code point"},
+		{`a\u{1234567}`, 2, KindBadEscape, "Too many hex digits"},
+		{`a\u{D800}`, 2, KindBadEscape, "Surrogate code point"},
+		{`a\u{110000}`, 2, KindBadEscape, "Code point out of range"},
+		{`a\u{12G}`, 2, KindBadEscape, "Not a hex digit"},
+		{strings.Repeat("(", defaultMaxDepth+1) + "a" + strings.Repeat(")", defaultMaxDepth+1), defaultMaxDepth + 1, KindDepthLimit, "Too deep nesting"},
+	}
+
+	for _, test := range errCases {
+		t.Run(test.hint, func(t *testing.T) {
+			_, err := Unpack(test.input)
+			var unpackErr UnpackError
+			if !errors.As(err, &unpackErr) || unpackErr.Column != test.column || unpackErr.Kind != test.kind {
+				t.Fatalf("Expected %s at column %d, got %v", test.kind, test.column, err)
+			}
+		})
+	}
+
+	t.Run("Depth limit option", func(t *testing.T) {
+		if _, err := UnpackWithOptions("((a))", UnpackOptions{MaxDepth: 1}); !errors.As(err, new(DepthLimitError)) {
+			t.Fatal("Expected DepthLimitError, got ", err)
+		}
+		deep := strings.Repeat("(", defaultMaxDepth+1) + "a" + strings.Repeat(")", defaultMaxDepth+1)
+		if _, err := UnpackWithOptions(deep, UnpackOptions{MaxDepth: -1}); !errors.As(err, new(DepthLimitError)) {
+			t.Fatal("Expected the default limit for a negative MaxDepth, got ", err)
+		}
+		if _, err := UnpackWithOptions("(a)", UnpackOptions{MaxDepth: 1}); err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+	})
+
+	t.Run("Groups count towards the output limit", func(t *testing.T) {
+		_, err := UnpackWithOptions("((a999999999)999999999)2", UnpackOptions{MaxOutputSize: 1 << 20})
+		if !errors.As(err, new(OutputLimitError)) {
+			t.Fatal("Expected OutputLimitError, got ", err)
+		}
+	})
+}
+
+func TestGraphemes(t *testing.T) {
+	const (
+		acute  = "\u0301"
+		zwj    = "\u200D"
+		family = "👨" + zwj + "👩" + zwj + "👧" + zwj + "👦"
+		// Флаг Англии: черный флаг и теги "gbeng" с завершающим тегом
+		england = "🏴\U000E0067\U000E0062\U000E0065\U000E006E\U000E0067\U000E007F"
+	)
+
+	testCases := []struct {
+		input     string
+		runes     string
+		graphemes string
+		hint      string
+	}{
+		{"e" + acute + "3", "e" + strings.Repeat(acute, 3), strings.Repeat("e"+acute, 3), "Combining mark"},
+		{"a" + acute + "\u0323" + "2", "a" + acute + strings.Repeat("\u0323", 2), strings.Repeat("a"+acute+"\u0323", 2), "Several combining marks"},
+		{"🇷🇺3", "🇷" + strings.Repeat("🇺", 3), strings.Repeat("🇷🇺", 3), "Flag"},
+		{"🇷🇺🇩🇪2", "🇷🇺🇩" + strings.Repeat("🇪", 2), "🇷🇺" + strings.Repeat("🇩🇪", 2), "Flags are pairs of regional indicators"},
+		{england + "2", "", strings.Repeat(england, 2), "Flag with tags"},
+		{family + "2", "", strings.Repeat(family, 2), "ZWJ sequence"},
+		{"👍🏽3", "👍" + strings.Repeat("🏽", 3), strings.Repeat("👍🏽", 3), "Skin tone modifier"},
+		{`\1` + "\uFE0F\u20E3" + "2", "1\uFE0F" + strings.Repeat("\u20E3", 2), strings.Repeat("1\uFE0F\u20E3", 2), "Keycap after an escaped digit"},
+		{"\u1100\u1161\u11A8" + "2", "\u1100\u1161" + strings.Repeat("\u11A8", 2), strings.Repeat("\u1100\u1161\u11A8", 2), "Hangul jamo"},
+		{"ab2", "abb", "abb", "Plain runes"},
+		{"(e" + acute + ")2" + acute, "", "e" + acute + "e" + acute + acute, "Group ends a grapheme"},
+		{"e" + `\u{301}` + "2", "e" + acute + acute, "e" + acute + acute, "Escaped mark starts a new grapheme"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			if test.runes != "" {
+				testOutput, err := Unpack(test.input)
+				if err != nil || testOutput != test.runes {
+					t.Fatalf("Wrong output without graphemes:\nexpected %q,\nrecieved %q, %v", test.runes, testOutput, err)
+				}
+			}
+
+			opts := UnpackOptions{Graphemes: true}
+			testOutput, err := UnpackWithOptions(test.input, opts)
+			if err != nil || testOutput != test.graphemes {
+				t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q, %v", test.graphemes, testOutput, err)
+			}
+
+			var b strings.Builder
+			if err := UnpackStream(iotest.OneByteReader(strings.NewReader(test.input)), &b, opts); err != nil || b.String() != test.graphemes {
+				t.Fatalf("Wrong stream output:\nexpected %q,\nrecieved %q, %v", test.graphemes, b.String(), err)
+			}
+		})
+	}
+
+	t.Run("Grapheme longer than the read window", func(t *testing.T) {
+		input := strings.Repeat(family, 3) + "2"
+		expected := strings.Repeat(family, 2) + strings.Repeat(family, 2)
+		var b strings.Builder
+		if err := UnpackStream(strings.NewReader(input), &b, UnpackOptions{Graphemes: true}); err != nil || b.String() != expected {
+			t.Fatalf("Wrong stream output:\nexpected %q,\nrecieved %q, %v", expected, b.String(), err)
+		}
+	})
+}
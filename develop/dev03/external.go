@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultBufferSize = 256 << 20
+
+// Порций строк во временных файлах не бывает больше: набравшиеся порции сливаются в одну,
+// чтобы при маленьком -S не упереться в лимит открытых файлов
+const maxOpenRuns = 64
+
+// Примерные накладные расходы на строку в памяти: Line и заголовки строк ключей
+const lineOverhead = 64
+
+type ExternalOptions struct {
+	// Примерный объём памяти под строки, после которого отсортированная порция сбрасывается во временный файл.
+	// Ноль - defaultBufferSize
+	BufferSize int64
+	// Каталог для отсортированных порций строк, как -T у GNU sort. Пустой - os.TempDir()
+	TempDir string
+}
+
+type BufferSizeError struct {
+	size string
+}
+
+func (err BufferSizeError) Error() string {
+	return "Invalid buffer size " + strconv.Quote(err.size)
+}
+
+// Размер буфера как в -S у GNU sort: число с суффиксом b, K, M, G или T, без суффикса - в килобайтах
+func ParseBufferSize(size string) (int64, error) {
+	multiplier := int64(1 << 10)
+	if size != "" {
+		switch size[len(size)-1] {
+		case 'b':
+			multiplier = 1
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		case 't', 'T':
+			multiplier = 1 << 40
+		default:
+			size += "K"
+		}
+	}
+	n, err := strconv.ParseInt(size[:max(len(size)-1, 0)], 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/multiplier {
+		return 0, BufferSizeError{size}
+	}
+	return n * multiplier, nil
+}
+
+// Порция строк, отсортированная по lineOrder: сброшенная во временный файл или последняя, оставшаяся в памяти
+type sortedRun interface {
+	next() (string, bool, error)
+}
+
+type sliceRun struct {
+	lines []string
+}
+
+func (sr *sliceRun) next() (string, bool, error) {
+	if len(sr.lines) == 0 {
+		return "", false, nil
+	}
+	line := sr.lines[0]
+	sr.lines = sr.lines[1:]
+	return line, true, nil
+}
+
+// Строки во временном файле разделены переводом строки, как во входном
+type fileRun struct {
+	file *os.File
+	r    *bufio.Reader
+}
+
+func (fr *fileRun) next() (string, bool, error) {
+	line, err := fr.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", false, nil
+	}
+	if err != nil && err != io.EOF {
+		return "", false, err
+	}
+	return strings.TrimSuffix(line, "\n"), true, nil
+}
+
+func (fr *fileRun) close() {
+	fr.file.Close()
+	os.Remove(fr.file.Name())
+}
+
+// Порядок строк по ключам -k, а без них - по колонке column как по ключу column,column.
+// Строки, равные по ключам, без -s сравниваются целиком, как в GNU sort, так что порядок не зависит от алгоритма сортировки
+type lineOrder struct {
+	separator string
+	flags     SortFlags
+	keys      []SortKey
+}
+
+func newLineOrder(column int, flags SortFlags, separator string) lineOrder {
+	keys := flags.keys
+	if len(keys) == 0 {
+		keys = []SortKey{{startField: column, endField: column}}
+	}
+	resolved := make([]SortKey, len(keys))
+	for i, key := range keys {
+		resolved[i] = key.resolve(flags)
+	}
+	return lineOrder{separator: separator, flags: flags, keys: resolved}
+}
+
+func (o lineOrder) compare(a, b Line) int {
+	if result := compareByKeys(a.keys, b.keys, o.keys); result != 0 || o.flags.stable {
+		return result
+	}
+	if o.flags.sortReverse {
+		return strings.Compare(b.text, a.text)
+	}
+	return strings.Compare(a.text, b.text)
+}
+
+func (o lineOrder) less(a, b Line) bool {
+	return o.compare(a, b) < 0
+}
+
+func (o lineOrder) sort(lines []Line) {
+	less := func(i, j int) bool {
+		return o.less(lines[i], lines[j])
+	}
+	if o.flags.stable {
+		sort.SliceStable(lines, less)
+	} else {
+		sort.Slice(lines, less)
+	}
+}
+
+func (o lineOrder) isSorted(lines []Line) bool {
+	return sort.SliceIsSorted(lines, func(i, j int) bool {
+		return o.less(lines[i], lines[j])
+	})
+}
+
+func (o lineOrder) split(line string, index int) Line {
+	return Line{text: line, keys: extractKeys(line, o.keys, o.separator), initialIndex: index}
+}
+
+type mergeItem struct {
+	line Line
+	run  sortedRun
+	// Номер последовательности: при равных строках раньше идёт более ранняя часть входа, что нужно для -s
+	position int
+}
+
+type mergeHeap struct {
+	items []mergeItem
+	order lineOrder
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+func (h *mergeHeap) Less(i, j int) bool {
+	if c := h.order.compare(h.items[i].line, h.items[j].line); c != 0 {
+		return c < 0
+	}
+	return h.items[i].position < h.items[j].position
+}
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *mergeHeap) Push(x any)    { h.items = append(h.items, x.(mergeItem)) }
+func (h *mergeHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+// Сливает порции кучей по lineOrder и передаёт строки в visit. Ключи строки выделяются один раз,
+// когда она попадает в кучу, и сравнения кучи поля заново не разбирают
+func mergeRuns(runs []sortedRun, order lineOrder, visit func(string) error) error {
+	h := &mergeHeap{order: order}
+	for position, r := range runs {
+		line, ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.items = append(h.items, mergeItem{order.split(line, 0), r, position})
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		if err := visit(h.items[0].line.text); err != nil {
+			return err
+		}
+		line, ok, err := h.items[0].run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.items[0].line = order.split(line, 0)
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// Сливает порции в новый временный файл строк, который дальше читается как одна порция
+func writeMergedRun(dir string, runs []sortedRun, order lineOrder) (*fileRun, error) {
+	file, err := os.CreateTemp(dir, "sort-*.run")
+	if err != nil {
+		return nil, err
+	}
+	merged := &fileRun{file: file}
+
+	w := bufio.NewWriter(file)
+	err = mergeRuns(runs, order, func(line string) error {
+		w.WriteString(line)
+		return w.WriteByte('\n')
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		merged.close()
+		return nil, err
+	}
+	merged.r = bufio.NewReader(file)
+	return merged, nil
+}
+
+// Сортирует порцию строк в памяти так же, как SortFile
+func sortChunk(lines []string, order lineOrder) []string {
+	splitLines := make([]Line, len(lines))
+	for i, line := range lines {
+		splitLines[i] = order.split(line, i)
+	}
+	order.sort(splitLines)
+
+	sorted := make([]string, len(lines))
+	for i, line := range splitLines {
+		sorted[i] = lines[line.initialIndex]
+	}
+	return sorted
+}
+
+// Проверка -c без чтения всего файла в память
+func checkStream(r io.Reader, w io.Writer, order lineOrder) error {
+	br := bufio.NewReader(r)
+	var prev Line
+	sorted := true
+	for first := true; ; first = false {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		current := order.split(strings.TrimSuffix(line, "\n"), 0)
+		if !first && order.less(current, prev) {
+			sorted = false
+			break
+		}
+		prev = current
+	}
+	if sorted {
+		_, err := io.WriteString(w, "Файл отсортирован\n")
+		return err
+	}
+	_, err := io.WriteString(w, "Файл не отсортирован\n")
+	return err
+}
+
+// Внешняя сортировка для файлов больше памяти: строки из r читаются порциями до opts.BufferSize,
+// каждая порция сортируется в памяти и сбрасывается во временный файл, а затем порции сливаются кучей в w.
+// Флаги и -u работают так же, как в SortFile, каждая строка выводится с переводом строки
+func SortStream(r io.Reader, w io.Writer, column int, flags SortFlags, separator string, opts ExternalOptions) error {
+	order := newLineOrder(column, flags, separator)
+	if flags.checkSorted {
+		return checkStream(r, w, order)
+	}
+	limit := opts.BufferSize
+	if limit == 0 {
+		limit = defaultBufferSize
+	}
+
+	runs := []sortedRun{}
+	defer func() {
+		for _, r := range runs {
+			if fr, ok := r.(*fileRun); ok {
+				fr.close()
+			}
+		}
+	}()
+
+	br := bufio.NewReader(r)
+	lines := []string{}
+	var used int64
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		lines = append(lines, line)
+		used += int64(len(line) + lineOverhead)
+		if used < limit {
+			continue
+		}
+
+		spilled, err := writeMergedRun(opts.TempDir, []sortedRun{&sliceRun{sortChunk(lines, order)}}, order)
+		if err != nil {
+			return err
+		}
+		runs = append(runs, spilled)
+		lines, used = lines[:0], 0
+
+		if len(runs) == maxOpenRuns {
+			merged, err := writeMergedRun(opts.TempDir, runs, order)
+			if err != nil {
+				return err
+			}
+			for _, r := range runs {
+				r.(*fileRun).close()
+			}
+			runs = []sortedRun{merged}
+		}
+	}
+	runs = append(runs, &sliceRun{sortChunk(lines, order)})
+
+	bw := bufio.NewWriter(w)
+	var prev string
+	first := true
+	err := mergeRuns(runs, order, func(line string) error {
+		if flags.removeRepeating && !first && line == prev {
+			return nil
+		}
+		prev, first = line, false
+		bw.WriteString(line)
+		return bw.WriteByte('\n')
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
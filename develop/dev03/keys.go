@@ -0,0 +1,330 @@
+package main
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Модификаторы ключа сортировки, как у GNU sort. Ключ без модификаторов берёт глобальные флаги
+type keyOptions struct {
+	numeric         bool
+	human           bool
+	month           bool
+	reverse         bool
+	skipStartBlanks bool
+	skipEndBlanks   bool
+	foldCase        bool
+	dictionary      bool
+}
+
+// Ключ -k в синтаксисе POSIX: F[.C][OPTS][,F[.C][OPTS]]. Поля и символы нумеруются с единицы,
+// символы считаются в рунах. Без конца ключ идёт до конца строки, без символа конца - до конца поля
+type SortKey struct {
+	startField int
+	startChar  int
+	endField   int
+	endChar    int
+	options    keyOptions
+}
+
+type KeyError struct {
+	spec   string
+	reason string
+}
+
+func (err KeyError) Error() string {
+	return "Invalid key " + strconv.Quote(err.spec) + ": " + err.reason
+}
+
+// Ключ по всей строке, как у sort без -k
+var wholeLineKey = SortKey{startField: 1}
+
+// Разбирает F[.C] и возвращает остаток спецификации
+func parsePosition(s string) (field, char int, rest string, ok bool) {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	field, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, 0, s, false
+	}
+	s = s[i:]
+	if !strings.HasPrefix(s, ".") {
+		return field, 0, s, true
+	}
+	s = s[1:]
+	i = 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	char, err = strconv.Atoi(s[:i])
+	if err != nil {
+		return 0, 0, s, false
+	}
+	return field, char, s[i:], true
+}
+
+// Модификаторы после позиции; b относится только к своей позиции
+func (key *SortKey) parseOptions(s string, end bool) bool {
+	for _, c := range s {
+		switch c {
+		case 'n':
+			key.options.numeric = true
+		case 'h':
+			key.options.human = true
+		case 'M':
+			key.options.month = true
+		case 'r':
+			key.options.reverse = true
+		case 'f':
+			key.options.foldCase = true
+		case 'd':
+			key.options.dictionary = true
+		case 'b':
+			if end {
+				key.options.skipEndBlanks = true
+			} else {
+				key.options.skipStartBlanks = true
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func ParseKey(spec string) (SortKey, error) {
+	start, end, hasEnd := strings.Cut(spec, ",")
+	var key SortKey
+	var rest string
+	var ok bool
+	key.startField, key.startChar, rest, ok = parsePosition(start)
+	if !ok {
+		return SortKey{}, KeyError{spec, "expected a field number"}
+	}
+	if key.startField == 0 {
+		return SortKey{}, KeyError{spec, "field number is zero"}
+	}
+	if strings.Contains(start, ".") && key.startChar == 0 {
+		return SortKey{}, KeyError{spec, "character offset is zero"}
+	}
+	if !key.parseOptions(rest, false) {
+		return SortKey{}, KeyError{spec, "unknown modifier"}
+	}
+	if !hasEnd {
+		return key, nil
+	}
+
+	key.endField, key.endChar, rest, ok = parsePosition(end)
+	if !ok {
+		return SortKey{}, KeyError{spec, "expected a field number after ','"}
+	}
+	if key.endField == 0 {
+		return SortKey{}, KeyError{spec, "field number is zero"}
+	}
+	if !key.parseOptions(rest, true) {
+		return SortKey{}, KeyError{spec, "unknown modifier"}
+	}
+	return key, nil
+}
+
+// Ключ без своих модификаторов сортируется по глобальным флагам
+func (key SortKey) resolve(flags SortFlags) SortKey {
+	if key.options == (keyOptions{}) {
+		key.options = keyOptions{
+			numeric:         flags.sortByNums,
+			human:           flags.sortByNumsWithSuffix,
+			month:           flags.sortByMonth,
+			reverse:         flags.sortReverse,
+			skipStartBlanks: flags.ignoreTrailingSpaces,
+			skipEndBlanks:   flags.ignoreTrailingSpaces,
+			foldCase:        flags.foldCase,
+			dictionary:      flags.dictionaryOrder,
+		}
+	}
+	return key
+}
+
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+func skipBlanks(line string, i int) int {
+	for i < len(line) && isBlank(line[i]) {
+		i++
+	}
+	return i
+}
+
+// Позиция после n полей. Без разделителя поле - пробелы перед ним и непробельные символы, как в GNU sort
+func skipFields(line string, i, n int, separator string, keepSeparator bool) int {
+	for ; i < len(line) && n > 0; n-- {
+		if separator != "" {
+			next := strings.Index(line[i:], separator)
+			if next < 0 {
+				return len(line)
+			}
+			i += next
+			if n > 1 || !keepSeparator {
+				i += len(separator)
+			}
+			continue
+		}
+		i = skipBlanks(line, i)
+		for i < len(line) && !isBlank(line[i]) {
+			i++
+		}
+	}
+	return i
+}
+
+// Сдвиг на n рун, но не дальше конца строки
+func skipChars(line string, i, n int) int {
+	for ; i < len(line) && n > 0; n-- {
+		_, size := utf8.DecodeRuneInString(line[i:])
+		i += size
+	}
+	return i
+}
+
+// Часть строки, по которой сравнивает ключ
+func (key SortKey) extract(line, separator string) string {
+	start := skipFields(line, 0, key.startField-1, separator, false)
+	if key.options.skipStartBlanks {
+		start = skipBlanks(line, start)
+	}
+	start = skipChars(line, start, max(key.startChar-1, 0))
+
+	end := len(line)
+	if key.endField != 0 {
+		if key.endChar == 0 {
+			// Конец ключа - конец поля, без разделителя после него
+			end = skipFields(line, 0, key.endField, separator, true)
+		} else {
+			end = skipFields(line, 0, key.endField-1, separator, false)
+			if key.options.skipEndBlanks {
+				end = skipBlanks(line, end)
+			}
+			end = skipChars(line, end, key.endChar)
+		}
+	}
+	if end < start {
+		return ""
+	}
+	return line[start:end]
+}
+
+// Числовой префикс как у -n: пробелы, знак, цифры и дробная часть. Не число - ноль и false
+func numericPrefix(s string) (float64, string, bool) {
+	s = strings.TrimLeft(s, " \t")
+	i := 0
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	digits := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i, digits = i+1, digits+1
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i, digits = i+1, digits+1
+		}
+	}
+	if digits == 0 {
+		return 0, s, false
+	}
+	value, _ := strconv.ParseFloat(strings.TrimSuffix(s[:i], "."), 64)
+	return value, s[i:], true
+}
+
+const humanSuffixes = "KMGTPEZYRQ"
+
+// Как -h у GNU sort: сначала знак, затем порядок суффикса, затем само число, так что 1023K < 1M
+func compareHuman(a, b string) int {
+	parse := func(s string) (float64, int) {
+		value, rest, ok := numericPrefix(s)
+		if !ok || rest == "" {
+			return value, 0
+		}
+		suffix := rest[0]
+		if suffix == 'k' {
+			suffix = 'K'
+		}
+		return value, strings.IndexByte(humanSuffixes, suffix) + 1
+	}
+	aValue, aSuffix := parse(a)
+	bValue, bSuffix := parse(b)
+	aSign, bSign := cmp.Compare(aValue, 0), cmp.Compare(bValue, 0)
+	if aSign != bSign {
+		return cmp.Compare(aSign, bSign)
+	}
+	return cmp.Or(cmp.Compare(aSuffix, bSuffix)*aSign, cmp.Compare(aValue, bValue))
+}
+
+func monthNumber(s string) int {
+	s = strings.TrimLeft(s, " \t")
+	if len(s) > 3 {
+		s = s[:3]
+	}
+	return monthOrdering[strings.ToUpper(s)]
+}
+
+// Текст ключа для сравнения с модификаторами f и d
+func (o keyOptions) text(s string) string {
+	if !o.foldCase && !o.dictionary {
+		return s
+	}
+	return strings.Map(func(r rune) rune {
+		if o.dictionary && !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' ' && r != '\t' {
+			return -1
+		}
+		if o.foldCase {
+			return unicode.ToUpper(r)
+		}
+		return r
+	}, s)
+}
+
+func (key SortKey) compare(a, b string) int {
+	var result int
+	switch {
+	case key.options.numeric:
+		aValue, _, _ := numericPrefix(a)
+		bValue, _, _ := numericPrefix(b)
+		result = cmp.Compare(aValue, bValue)
+	case key.options.human:
+		result = compareHuman(a, b)
+	case key.options.month:
+		result = cmp.Compare(monthNumber(a), monthNumber(b))
+	default:
+		result = strings.Compare(key.options.text(a), key.options.text(b))
+	}
+	if key.options.reverse {
+		return -result
+	}
+	return result
+}
+
+// Части строки по каждому из ключей
+func extractKeys(line string, keys []SortKey, separator string) []string {
+	extracted := make([]string, len(keys))
+	for i, key := range keys {
+		extracted[i] = key.extract(line, separator)
+	}
+	return extracted
+}
+
+// Сравнение выделенных частей строк по ключам по порядку: следующий ключ сравнивается, только если предыдущие равны
+func compareByKeys(a, b []string, keys []SortKey) int {
+	for i, key := range keys {
+		if c := key.compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
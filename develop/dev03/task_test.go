@@ -1,6 +1,13 @@
 package main
 
-import "testing"
+import (
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
 
 type sortFileInput struct {
 	file      string
@@ -256,6 +263,266 @@ ss sadsf`,
 	}
 }
 
+// Строки с уникальными ключами в первых двух колонках и повторами целых строк, чтобы порядок не зависел
+// от устойчивости сортировки
+func generateLines(size int) []string {
+	rng := rand.New(rand.NewPCG(1, 2))
+	months := []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+	lines := []string{}
+	for i := range size {
+		if i != 0 && rng.IntN(5) == 0 {
+			lines = append(lines, lines[rng.IntN(len(lines))])
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%d w%x %s", rng.Int64N(1<<50), rng.Int64(), months[rng.IntN(len(months))]))
+	}
+	return lines
+}
+
+func TestExternalSort(t *testing.T) {
+	lines := generateLines(3000)
+	file := strings.Join(lines, "\n")
+
+	testCases := []testCase[sortFileInput, ExternalOptions]{
+		{sortFileInput{column: 1}, ExternalOptions{}, "Everything fits in memory"},
+		{sortFileInput{column: 1, sortFlags: SortFlags{sortByNums: true}}, ExternalOptions{BufferSize: 4096}, "Numbers in temporary files"},
+		{sortFileInput{column: 2, sortFlags: SortFlags{sortReverse: true}}, ExternalOptions{BufferSize: 4096}, "Reversed second column"},
+		{sortFileInput{column: 1, sortFlags: SortFlags{sortByNums: true, removeRepeating: true}}, ExternalOptions{BufferSize: 4096}, "Without duplicates"},
+		{sortFileInput{column: 2, sortFlags: SortFlags{removeRepeating: true}}, ExternalOptions{BufferSize: 1}, "One line per temporary file"},
+		{sortFileInput{column: 1, sortFlags: SortFlags{keys: mustParseKeys(t, "3,3M", "1.1,1.2nr")}}, ExternalOptions{BufferSize: 4096}, "Keys in temporary files"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			dir := t.TempDir()
+			test.output.TempDir = dir
+			expected := SortFile(file, test.input.column, test.input.sortFlags, DefaultSeparator) + "\n"
+
+			var b strings.Builder
+			err := SortStream(strings.NewReader(file+"\n"), &b, test.input.column, test.input.sortFlags, DefaultSeparator, test.output)
+			if err != nil {
+				t.Fatal("Error while sorting: ", err)
+			}
+			if b.String() != expected {
+				t.Fatalf("Wrong output: expected %d bytes, recieved %d", len(expected), b.Len())
+			}
+
+			if files, _ := os.ReadDir(dir); len(files) != 0 {
+				t.Fatalf("Temporary files weren't removed: %d left", len(files))
+			}
+		})
+	}
+
+	t.Run("Check sorted", func(t *testing.T) {
+		sorted := SortFile(file, 1, SortFlags{}, DefaultSeparator)
+		for input, expected := range map[string]string{sorted: "Файл отсортирован\n", file: "Файл не отсортирован\n"} {
+			var b strings.Builder
+			if err := SortStream(strings.NewReader(input), &b, 1, SortFlags{checkSorted: true}, DefaultSeparator, ExternalOptions{}); err != nil || b.String() != expected {
+				t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q, %v", expected, b.String(), err)
+			}
+		}
+	})
+}
+
+func TestParseBufferSize(t *testing.T) {
+	testCases := []testCase[string, int64]{
+		{"100b", 100, "Bytes"},
+		{"4", 4 << 10, "Kilobytes by default"},
+		{"512M", 512 << 20, "Megabytes"},
+		{"2G", 2 << 30, "Gigabytes"},
+		{"", 0, "Empty size"},
+		{"M", 0, "Only a suffix"},
+		{"-5K", 0, "Negative size"},
+		{"10X", 0, "Unknown suffix"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			testedOutput, err := ParseBufferSize(test.input)
+			if testedOutput != test.output || (err == nil) != (test.output != 0) {
+				t.Fatalf("Wrong output:\nexpected %v,\nrecieved %v, %v\n", test.output, testedOutput, err)
+			}
+		})
+	}
+}
+
+func mustParseKeys(t *testing.T, specs ...string) []SortKey {
+	keys := []SortKey{}
+	for _, spec := range specs {
+		key, err := ParseKey(spec)
+		if err != nil {
+			t.Fatal("Error while parsing the key: ", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Ожидаемые результаты совпадают с выводом GNU sort при LC_ALL=C
+func TestSortKeys(t *testing.T) {
+	file := `b 2 x
+a 10 y
+c 2 a
+d 1K z
+e  1M z
+f 2 a`
+
+	type keysInput struct {
+		keys      []string
+		sortFlags SortFlags
+		separator string
+	}
+	testCases := []testCase[keysInput, string]{
+		{keysInput{keys: []string{"2,2n", "1,1r"}}, `e  1M z
+d 1K z
+f 2 a
+c 2 a
+b 2 x
+a 10 y`, "Numeric key with a reversed tiebreaker"},
+		{keysInput{keys: []string{"2,2h"}}, `b 2 x
+c 2 a
+f 2 a
+a 10 y
+d 1K z
+e  1M z`, "Human numbers and the whole line as the last resort"},
+		{keysInput{keys: []string{"3,3", "2,2nr"}}, `c 2 a
+f 2 a
+b 2 x
+a 10 y
+d 1K z
+e  1M z`, "Reversed second key"},
+		{keysInput{keys: []string{"2,2"}}, `e  1M z
+a 10 y
+d 1K z
+b 2 x
+c 2 a
+f 2 a`, "Leading blanks belong to the field"},
+		{keysInput{keys: []string{"2b,2"}}, `a 10 y
+d 1K z
+e  1M z
+b 2 x
+c 2 a
+f 2 a`, "Leading blanks are skipped with b"},
+		{keysInput{keys: []string{"2.2,2.2", "1,1"}, sortFlags: SortFlags{sortReverse: true}}, `f 2 a
+c 2 a
+b 2 x
+d 1K z
+a 10 y
+e  1M z`, "Character positions and global reverse"},
+		{keysInput{keys: []string{"2,2n"}, sortFlags: SortFlags{sortReverse: true}}, `e  1M z
+d 1K z
+f 2 a
+c 2 a
+b 2 x
+a 10 y`, "Key with modifiers doesn't inherit global reverse"},
+		{keysInput{keys: []string{"2,2"}, separator: "1"}, `b 2 x
+c 2 a
+f 2 a
+a 10 y
+d 1K z
+e  1M z`, "Explicit separator"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			test.input.sortFlags.keys = mustParseKeys(t, test.input.keys...)
+			testedOutput := SortFile(file, 1, test.input.sortFlags, test.input.separator)
+			if testedOutput != test.output {
+				t.Fatalf("Wrong output:\nexpected\n%s\nrecieved\n%s", test.output, testedOutput)
+			}
+		})
+	}
+
+	t.Run("Fold case and dictionary order", func(t *testing.T) {
+		flags := SortFlags{foldCase: true, dictionaryOrder: true, keys: []SortKey{wholeLineKey}}
+		expected := "Ab\nab\na-c\nb"
+		if testedOutput := SortFile("b\nab\nAb\na-c", 1, flags, ""); testedOutput != expected {
+			t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q", expected, testedOutput)
+		}
+	})
+
+	t.Run("Column is a key", func(t *testing.T) {
+		// Не-числа считаются нулём, как у ключа 2,2n, а не идут первыми
+		flags := SortFlags{sortByNums: true}
+		expected := SortFile(file, 1, SortFlags{keys: mustParseKeys(t, "2,2n")}, DefaultSeparator)
+		if testedOutput := SortFile(file, 2, flags, DefaultSeparator); testedOutput != expected {
+			t.Fatalf("Wrong output:\nexpected\n%s\nrecieved\n%s", expected, testedOutput)
+		}
+
+		var b strings.Builder
+		if err := SortStream(strings.NewReader("x -1\ny abc\nz 2\n"), &b, 2, flags, DefaultSeparator, ExternalOptions{}); err != nil {
+			t.Fatal("Unexpected error: ", err)
+		}
+		if expected := "x -1\ny abc\nz 2\n"; b.String() != expected {
+			t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q", expected, b.String())
+		}
+	})
+
+	for _, spec := range []string{"0", "1.0", "a", "1,", "1,0", "1x", "2,3q"} {
+		if _, err := ParseKey(spec); err == nil {
+			t.Fatalf("Expected an error for the key %q", spec)
+		}
+	}
+}
+
+func TestStableSort(t *testing.T) {
+	file := `b 2
+a 1
+c 2
+a 2
+d 1
+b 1`
+
+	testCases := []testCase[SortFlags, string]{
+		{SortFlags{stable: true}, "a 1\nd 1\nb 1\nb 2\nc 2\na 2", "Input order for equal keys"},
+		{SortFlags{}, "a 1\nb 1\nd 1\na 2\nb 2\nc 2", "Whole line as the last resort"},
+		{SortFlags{stable: true, sortReverse: true}, "b 2\nc 2\na 2\na 1\nd 1\nb 1", "Reverse keeps input order"},
+		{SortFlags{sortReverse: true}, "c 2\nb 2\na 2\nd 1\nb 1\na 1", "Reversed last resort"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			test.input.keys = mustParseKeys(t, "2,2")
+			testedOutput := SortFile(file, 1, test.input, "")
+			if testedOutput != test.output {
+				t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q", test.output, testedOutput)
+			}
+
+			// Без -k сравнивается вторая колонка, результат тот же
+			test.input.keys = nil
+			if testedOutput := SortFile(file, 2, test.input, " "); testedOutput != test.output {
+				t.Fatalf("Wrong output by column:\nexpected %q,\nrecieved %q", test.output, testedOutput)
+			}
+		})
+	}
+
+	// Много равных ключей: результат одинаков при каждом запуске, в памяти и с временными файлами,
+	// и совпадает с устойчивой сортировкой по номеру строки
+	lines := generateLines(2000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%d %s", i%7, lines[i])
+	}
+	file = strings.Join(lines, "\n")
+	flags := SortFlags{stable: true, keys: mustParseKeys(t, "1,1n")}
+	expected := SortFile(file, 1, flags, "") + "\n"
+
+	reference := slices.Clone(lines)
+	slices.SortStableFunc(reference, func(a, b string) int { return strings.Compare(a[:1], b[:1]) })
+	if expected != strings.Join(reference, "\n")+"\n" {
+		t.Fatal("Stable sort doesn't keep the input order")
+	}
+
+	for range 10 {
+		var b strings.Builder
+		if err := SortStream(strings.NewReader(file), &b, 1, flags, "", ExternalOptions{BufferSize: 2048, TempDir: t.TempDir()}); err != nil {
+			t.Fatal("Error while sorting: ", err)
+		}
+		if b.String() != expected {
+			t.Fatal("Different output for equal keys")
+		}
+	}
+}
+
 func BenchmarkSortFile(b *testing.B) {
 	file := `123 12 3 12 3123 
 
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+const usage = `Использование:
+	dev04 group [-format text|json|csv] [-min-size N] [-sort key|size] [-stats] [словарь ...]
+	                                          сгруппировать анаграммы словаря (по умолчанию из STDIN)
+	dev04 index -o файл.idx [словарь ...]     построить индекс анаграмм по словарю (по умолчанию из STDIN)
+	dev04 query -index файл.idx слово ...     напечатать анаграммы слов из индекса
+	dev04 serve -index файл.idx -addr :8080   HTTP API: /anagrams?word=X и /is-anagram?a=X&b=Y
+`
+
+// Слова словаря по одному на строку, пустые строки пропускаются
+func readWords(r io.Reader) ([]string, error) {
+	words := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" {
+			words = append(words, word)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// Словари из файлов по порядку или STDIN, если файлов нет
+func readDictionaries(paths []string, stdin io.Reader) ([]string, error) {
+	if len(paths) == 0 {
+		return readWords(stdin)
+	}
+	words := []string{}
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fileWords, err := readWords(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		words = append(words, fileWords...)
+	}
+	return words, nil
+}
+
+func loadIndexFile(path string) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return LoadIndex(file)
+}
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func parseFlags(flags *flag.FlagSet, args []string) (int, bool) {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+func runIndex(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var output string
+	flags := newFlagSet("index", stderr)
+	flags.StringVar(&output, "o", "", "Файл, в который записывается индекс")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if output == "" {
+		fmt.Fprintln(stderr, "Не указан файл индекса -o")
+		return exitUsage
+	}
+
+	words, err := readDictionaries(flags.Args(), stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, "Ошибка во время чтения словаря: ", err)
+		return exitFailed
+	}
+	idx := NewIndex(words)
+
+	file, err := os.Create(output)
+	if err != nil {
+		fmt.Fprintln(stderr, "Ошибка во время записи индекса: ", err)
+		return exitFailed
+	}
+	if err := idx.Save(file); err != nil {
+		file.Close()
+		fmt.Fprintln(stderr, "Ошибка во время записи индекса: ", err)
+		return exitFailed
+	}
+	if err := file.Close(); err != nil {
+		fmt.Fprintln(stderr, "Ошибка во время записи индекса: ", err)
+		return exitFailed
+	}
+	fmt.Fprintf(stdout, "Проиндексировано слов: %d, групп анаграмм: %d\n", len(words), len(idx.Groups()))
+	return exitOK
+}
+
+type anagramGroup struct {
+	Key   string   `json:"key"`
+	Words []string `json:"words"`
+}
+
+func writeGroups(w io.Writer, format string, groups []anagramGroup) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(groups)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"key", "size", "words"})
+		for _, group := range groups {
+			cw.Write([]string{group.Key, strconv.Itoa(len(group.Words)), strings.Join(group.Words, " ")})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	bw := bufio.NewWriter(w)
+	for _, group := range groups {
+		fmt.Fprintf(bw, "%s: %s\n", group.Key, strings.Join(group.Words, " "))
+	}
+	return bw.Flush()
+}
+
+// Слова в нижнем регистре без повторов, в порядке первого появления
+func distinctWords(words []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, word := range words {
+		word = normalize(word)
+		if !seen[word] {
+			seen[word] = true
+			result = append(result, word)
+		}
+	}
+	return result
+}
+
+// Статистика пишется в STDERR, чтобы не смешиваться с группами в формате JSON или CSV.
+// Группы и самая большая из них считаются по выведенным группам, а слова без анаграмм - по всему словарю
+func writeGroupStats(w io.Writer, words []string, groups []anagramGroup, all map[string][]string) {
+	var largest *anagramGroup
+	for i := range groups {
+		if largest == nil || len(groups[i].Words) > len(largest.Words) {
+			largest = &groups[i]
+		}
+	}
+	grouped := 0
+	for _, group := range all {
+		grouped += len(group)
+	}
+	fmt.Fprintf(w, "Групп анаграмм: %d\n", len(groups))
+	if largest == nil {
+		fmt.Fprintln(w, "Самая большая группа: нет")
+	} else {
+		fmt.Fprintf(w, "Самая большая группа: %d (%s)\n", len(largest.Words), strings.Join(largest.Words, " "))
+	}
+	fmt.Fprintf(w, "Слов без анаграмм: %d\n", len(words)-grouped)
+}
+
+func runGroup(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var format, sortBy string
+	var minSize int
+	var stats bool
+	flags := newFlagSet("group", stderr)
+	flags.StringVar(&format, "format", "text", "Формат вывода: text, json или csv")
+	flags.IntVar(&minSize, "min-size", 2, "Наименьший размер выводимой группы")
+	flags.StringVar(&sortBy, "sort", "key", "Порядок групп: key - по ключу, size - по убыванию размера")
+	flags.BoolVar(&stats, "stats", false, "Вывести в STDERR число групп, самую большую группу и число слов без анаграмм")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+	if format != "text" && format != "json" && format != "csv" {
+		fmt.Fprintf(stderr, "Неизвестный формат вывода %q\n", format)
+		return exitUsage
+	}
+	if sortBy != "key" && sortBy != "size" {
+		fmt.Fprintf(stderr, "Неизвестный порядок групп %q\n", sortBy)
+		return exitUsage
+	}
+	if minSize < 0 {
+		fmt.Fprintln(stderr, "Размер группы -min-size не может быть отрицательным")
+		return exitUsage
+	}
+
+	words, err := readDictionaries(flags.Args(), stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, "Ошибка во время чтения словаря: ", err)
+		return exitFailed
+	}
+	words = distinctWords(words)
+	result := GroupByAnagrams(words)
+
+	groups := []anagramGroup{}
+	for key, group := range result {
+		if len(group) >= minSize {
+			groups = append(groups, anagramGroup{key, group})
+		}
+	}
+	slices.SortFunc(groups, func(a, b anagramGroup) int {
+		if sortBy == "size" {
+			return cmp.Or(cmp.Compare(len(b.Words), len(a.Words)), strings.Compare(a.Key, b.Key))
+		}
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	if err := writeGroups(stdout, format, groups); err != nil {
+		fmt.Fprintln(stderr, "Ошибка во время вывода групп: ", err)
+		return exitFailed
+	}
+	if stats {
+		writeGroupStats(stderr, words, groups, result)
+	}
+	return exitOK
+}
+
+func runQuery(args []string, stdout, stderr io.Writer) int {
+	var indexFile string
+	flags := newFlagSet("query", stderr)
+	flags.StringVar(&indexFile, "index", "", "Файл индекса, построенный командой index")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+
+	idx, err := loadIndexFile(indexFile)
+	if err != nil {
+		fmt.Fprintln(stderr, "Ошибка во время загрузки индекса: ", err)
+		return exitFailed
+	}
+	for _, word := range flags.Args() {
+		fmt.Fprintf(stdout, "%s: %s\n", word, strings.Join(idx.Anagrams(word), " "))
+	}
+	return exitOK
+}
+
+func runServe(args []string, stdout, stderr io.Writer) int {
+	var indexFile, addr string
+	flags := newFlagSet("serve", stderr)
+	flags.StringVar(&indexFile, "index", "", "Файл индекса, построенный командой index")
+	flags.StringVar(&addr, "addr", ":8080", "Адрес HTTP-сервера")
+	if code, ok := parseFlags(flags, args); !ok {
+		return code
+	}
+
+	idx, err := loadIndexFile(indexFile)
+	if err != nil {
+		fmt.Fprintln(stderr, "Ошибка во время загрузки индекса: ", err)
+		return exitFailed
+	}
+	fmt.Fprintf(stdout, "Сервер анаграмм слушает %s\n", addr)
+	fmt.Fprintln(stderr, http.ListenAndServe(addr, NewIndexHandler(idx)))
+	return exitFailed
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	switch args[0] {
+	case "group":
+		return runGroup(args[1:], stdin, stdout, stderr)
+	case "index":
+		return runIndex(args[1:], stdin, stdout, stderr)
+	case "query":
+		return runQuery(args[1:], stdout, stderr)
+	case "serve":
+		return runServe(args[1:], stdout, stderr)
+	}
+	fmt.Fprintf(stderr, "Неизвестная команда %q\n", args[0])
+	fmt.Fprint(stderr, usage)
+	return exitUsage
+}
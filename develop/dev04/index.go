@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var ErrBadIndex = errors.New("Not an anagram index or the index is corrupted")
+
+// Формат файла индекса: сигнатура формата, число групп, затем для каждой группы число слов,
+// номер ключа группы среди слов и слова с длинами. Все числа - uvarint, группы идут по возрастанию сигнатур,
+// так что один и тот же индекс всегда сохраняется одинаково. Сигнатуры пересчитываются при загрузке
+const indexMagic = "ANAGRAM2"
+
+func normalize(word string) string {
+	if !IsLower(word) {
+		return strings.ToLower(word)
+	}
+	return word
+}
+
+// Группа индекса: слова по алфавиту без повторов и ключ - первое встретившееся в словаре слово, как в GroupByAnagrams
+type indexGroup struct {
+	key   string
+	words []string
+}
+
+// Индекс анаграмм словаря по сигнатурам. В отличие от результата GroupByAnagrams,
+// хранит и слова без анаграмм, чтобы находить их по перестановкам
+type Index struct {
+	groups map[string]indexGroup
+}
+
+func NewIndex(words []string) *Index {
+	idx := &Index{groups: map[string]indexGroup{}}
+	for key, group := range GroupByAnagrams(words) {
+		idx.groups[GetCharCounts(key)] = indexGroup{key: key, words: slices.Compact(group)}
+	}
+	var buf []byte
+	for _, word := range words {
+		word = normalize(word)
+		buf = AppendSignature(buf[:0], word)
+		if _, ok := idx.groups[string(buf)]; !ok {
+			idx.groups[string(buf)] = indexGroup{key: word, words: []string{word}}
+		}
+	}
+	return idx
+}
+
+func IsAnagram(a, b string) bool {
+	a, b = normalize(a), normalize(b)
+	return a != b && GetCharCounts(a) == GetCharCounts(b)
+}
+
+// Слова словаря из тех же букв, что и word, кроме самого word
+func (idx *Index) Anagrams(word string) []string {
+	word = normalize(word)
+	result := []string{}
+	for _, candidate := range idx.groups[GetCharCounts(word)].words {
+		if candidate != word {
+			result = append(result, candidate)
+		}
+	}
+	return result
+}
+
+func (idx *Index) Contains(word string) bool {
+	word = normalize(word)
+	_, found := slices.BinarySearch(idx.groups[GetCharCounts(word)].words, word)
+	return found
+}
+
+// Группы из двух и больше слов в формате GroupByAnagrams
+func (idx *Index) Groups() map[string][]string {
+	result := map[string][]string{}
+	for _, group := range idx.groups {
+		if len(group.words) > 1 {
+			result[group.key] = group.words
+		}
+	}
+	return result
+}
+
+func (idx *Index) Save(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(indexMagic)
+	buf := make([]byte, 0, binary.MaxVarintLen64)
+	bw.Write(binary.AppendUvarint(buf, uint64(len(idx.groups))))
+	for _, signature := range slices.Sorted(maps.Keys(idx.groups)) {
+		group := idx.groups[signature]
+		bw.Write(binary.AppendUvarint(buf, uint64(len(group.words))))
+		keyIndex, _ := slices.BinarySearch(group.words, group.key)
+		bw.Write(binary.AppendUvarint(buf, uint64(keyIndex)))
+		for _, word := range group.words {
+			bw.Write(binary.AppendUvarint(buf, uint64(len(word))))
+			bw.WriteString(word)
+		}
+	}
+	return bw.Flush()
+}
+
+func LoadIndex(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(indexMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != indexMagic {
+		return nil, ErrBadIndex
+	}
+
+	readCount := func() (int, error) {
+		n, err := binary.ReadUvarint(br)
+		// Число больше оставшихся данных возможно только в испорченном файле
+		if err != nil || n > 1<<32 {
+			return 0, ErrBadIndex
+		}
+		return int(n), nil
+	}
+	groupCount, err := readCount()
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{groups: make(map[string]indexGroup, min(groupCount, 1<<20))}
+	var word strings.Builder
+	for range groupCount {
+		wordCount, err := readCount()
+		if err != nil || wordCount == 0 {
+			return nil, ErrBadIndex
+		}
+		keyIndex, err := readCount()
+		if err != nil || keyIndex >= wordCount {
+			return nil, ErrBadIndex
+		}
+		group := make([]string, 0, min(wordCount, 1024))
+		for range wordCount {
+			size, err := readCount()
+			if err != nil {
+				return nil, err
+			}
+			// Длине из файла не доверяем: буфер растёт по мере чтения, а не выделяется сразу
+			word.Reset()
+			if _, err := io.CopyN(&word, br, int64(size)); err != nil {
+				return nil, ErrBadIndex
+			}
+			group = append(group, word.String())
+		}
+		idx.groups[GetCharCounts(group[0])] = indexGroup{key: group[keyIndex], words: group}
+	}
+	return idx, nil
+}
+
+// HTTP API индекса:
+//
+//	GET /anagrams?word=пятак           -> {"word": "пятак", "anagrams": ["пятка", "тяпка"]}
+//	GET /is-anagram?a=пятак&b=тяпка    -> {"a": "пятак", "b": "тяпка", "anagram": true}
+func NewIndexHandler(idx *Index) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /anagrams", func(w http.ResponseWriter, r *http.Request) {
+		word := r.URL.Query().Get("word")
+		if word == "" {
+			http.Error(w, "Missing the word parameter", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]any{"word": word, "anagrams": idx.Anagrams(word)})
+	})
+	mux.HandleFunc("GET /is-anagram", func(w http.ResponseWriter, r *http.Request) {
+		a, b := r.URL.Query().Get("a"), r.URL.Query().Get("b")
+		if a == "" || b == "" {
+			http.Error(w, "Missing the a or b parameter", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]any{"a": a, "b": b, "anagram": IsAnagram(a, b)})
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, fmt.Sprint("Error while encoding the response: ", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Что ещё, кроме регистра, не учитывается при сравнении слов
+type NormalizeOptions struct {
+	// Ё считается той же буквой, что и Е
+	FoldYo bool
+	// Пробелы не учитываются, так что анаграммами могут быть фразы из нескольких слов
+	IgnoreSpaces bool
+	// Знаки препинания не учитываются: дефисы, апострофы, запятые и т.п.
+	IgnorePunctuation bool
+	// Буквы сравниваются без диакритических знаков: слово раскладывается в NFD и комбинирующие знаки отбрасываются.
+	// Это относится и к Й, которая раскладывается на И и кратку, и к Ё
+	StripDiacritics bool
+}
+
+// Слово в нижнем регистре без того, что opts велит не учитывать
+func (opts NormalizeOptions) Normalize(word string) string {
+	word = strings.ToLower(word)
+	if opts.StripDiacritics {
+		word = norm.NFD.String(word)
+	}
+
+	var b strings.Builder
+	b.Grow(len(word))
+	for _, r := range word {
+		switch {
+		case opts.StripDiacritics && unicode.Is(unicode.Mn, r):
+			continue
+		case opts.IgnoreSpaces && unicode.IsSpace(r):
+			continue
+		case opts.IgnorePunctuation && unicode.IsPunct(r):
+			continue
+		case opts.FoldYo && r == 'ё':
+			r = 'е'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// GroupByAnagrams со сравнением слов по opts. В группах остаются слова в исходном виде, как в словаре,
+// а одинаковые написания встречаются один раз. Слова, от которых после нормализации ничего не осталось, пропускаются
+func GroupByAnagramsWithOptions(words []string, opts NormalizeOptions) map[string][]string {
+	groupIndex := map[string]int{}
+	groups := [][]string{}
+	var buf []byte
+
+	for _, word := range words {
+		normalized := opts.Normalize(word)
+		if normalized == "" {
+			continue
+		}
+
+		buf = AppendSignature(buf[:0], normalized)
+		if i, ok := groupIndex[string(buf)]; ok {
+			groups[i] = append(groups[i], word)
+		} else {
+			groupIndex[string(buf)] = len(groups)
+			groups = append(groups, []string{word})
+		}
+	}
+
+	result := map[string][]string{}
+	for _, arr := range groups {
+		newKey := arr[0]
+		slices.Sort(arr)
+		arr = slices.Compact(arr)
+		if len(arr) > 1 {
+			result[newKey] = arr
+		}
+	}
+	return result
+}
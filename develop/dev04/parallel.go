@@ -0,0 +1,103 @@
+package main
+
+import (
+	"hash/maphash"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Сигнатуры части словаря: подряд в одном буфере, ends[i] - конец сигнатуры i-го слова
+type signatureChunk struct {
+	words  []string
+	buf    []byte
+	ends   []int
+	shards []int
+}
+
+func (c *signatureChunk) signature(i int) []byte {
+	start := 0
+	if i != 0 {
+		start = c.ends[i-1]
+	}
+	return c.buf[start:c.ends[i]]
+}
+
+// Параллельная версия GroupByAnagrams с тем же результатом. Сначала workers горутин считают сигнатуры
+// своих частей словаря, затем каждая горутина группирует слова своего шарда сигнатур, проходя словарь по порядку,
+// чтобы ключом группы осталось первое слово. workers <= 0 - по числу процессоров
+func GroupByAnagramsParallel(words []string, workers int) map[string][]string {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	seed := maphash.MakeSeed()
+
+	chunks := make([]signatureChunk, workers)
+	chunkSize := (len(words) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for w := range chunks {
+		start, end := min(w*chunkSize, len(words)), min((w+1)*chunkSize, len(words))
+		wg.Add(1)
+		go func(c *signatureChunk, words []string) {
+			defer wg.Done()
+			c.words = make([]string, len(words))
+			c.ends = make([]int, len(words))
+			c.shards = make([]int, len(words))
+			for i, word := range words {
+				if !IsLower(word) {
+					word = strings.ToLower(word)
+				}
+				c.words[i] = word
+				start := len(c.buf)
+				c.buf = AppendSignature(c.buf, word)
+				c.ends[i] = len(c.buf)
+				c.shards[i] = int(maphash.Bytes(seed, c.buf[start:]) % uint64(workers))
+			}
+		}(&chunks[w], words[start:end])
+	}
+	wg.Wait()
+
+	results := make([]map[string][]string, workers)
+	for shard := range results {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			groupIndex := map[string]int{}
+			groups := [][]string{}
+			for c := range chunks {
+				chunk := &chunks[c]
+				for i, word := range chunk.words {
+					if chunk.shards[i] != shard {
+						continue
+					}
+					signature := chunk.signature(i)
+					if g, ok := groupIndex[string(signature)]; ok {
+						groups[g] = append(groups[g], word)
+					} else {
+						groupIndex[string(signature)] = len(groups)
+						groups = append(groups, []string{word})
+					}
+				}
+			}
+
+			results[shard] = map[string][]string{}
+			for _, group := range groups {
+				if len(group) > 1 {
+					key := group[0]
+					slices.Sort(group)
+					results[shard][key] = group
+				}
+			}
+		}(shard)
+	}
+	wg.Wait()
+
+	result := results[0]
+	for _, shardResult := range results[1:] {
+		for key, group := range shardResult {
+			result[key] = group
+		}
+	}
+	return result
+}
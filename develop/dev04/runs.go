@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"os"
+	"slices"
+)
+
+// Столько порций одного уровня сливаются в одну порцию следующего уровня. Каждая запись
+// переписывается по разу на уровень, то есть логарифм от числа порций раз, а не при каждом слиянии
+const mergeFanIn = 16
+
+// Отсортированная последовательность записей: временный файл или остаток в памяти
+type sortedRun[T any] interface {
+	next() (T, bool, error)
+}
+
+type sliceRun[T any] struct {
+	items []T
+}
+
+func (sr *sliceRun[T]) next() (T, bool, error) {
+	var item T
+	if len(sr.items) == 0 {
+		return item, false, nil
+	}
+	item, sr.items = sr.items[0], sr.items[1:]
+	return item, true, nil
+}
+
+// Как записи кодируются во временном файле. decode возвращает io.EOF только в конце файла между записями
+type runCodec[T any] struct {
+	encode func(w *bufio.Writer, item T) error
+	decode func(r *bufio.Reader) (T, error)
+}
+
+type fileRun[T any] struct {
+	file  *os.File
+	r     *bufio.Reader
+	codec runCodec[T]
+}
+
+func (fr *fileRun[T]) next() (T, bool, error) {
+	item, err := fr.codec.decode(fr.r)
+	if err == io.EOF {
+		return item, false, nil
+	}
+	return item, err == nil, err
+}
+
+func (fr *fileRun[T]) close() {
+	fr.file.Close()
+	os.Remove(fr.file.Name())
+}
+
+type mergeItem[T any] struct {
+	item T
+	run  sortedRun[T]
+}
+
+type mergeHeap[T any] struct {
+	items   []mergeItem[T]
+	compare func(a, b T) int
+}
+
+func (h *mergeHeap[T]) Len() int           { return len(h.items) }
+func (h *mergeHeap[T]) Less(i, j int) bool { return h.compare(h.items[i].item, h.items[j].item) < 0 }
+func (h *mergeHeap[T]) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *mergeHeap[T]) Push(x any)         { h.items = append(h.items, x.(mergeItem[T])) }
+func (h *mergeHeap[T]) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
+
+// Слияние отсортированных последовательностей кучей, visit получает записи по порядку compare
+func mergeRuns[T any](runs []sortedRun[T], compare func(a, b T) int, visit func(T) error) error {
+	h := &mergeHeap[T]{compare: compare}
+	for _, r := range runs {
+		item, ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.items = append(h.items, mergeItem[T]{item, r})
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		if err := visit(h.items[0].item); err != nil {
+			return err
+		}
+		item, ok, err := h.items[0].run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.items[0].item = item
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+// Внешняя сортировка: порции записей сортируются в памяти и сбрасываются во временные файлы по уровням.
+// На уровне i лежат порции, слитые из mergeFanIn^i исходных
+type externalSorter[T any] struct {
+	dir     string
+	pattern string
+	compare func(a, b T) int
+	codec   runCodec[T]
+	levels  [][]*fileRun[T]
+}
+
+func (s *externalSorter[T]) writeRun(runs []sortedRun[T]) (*fileRun[T], error) {
+	file, err := os.CreateTemp(s.dir, s.pattern)
+	if err != nil {
+		return nil, err
+	}
+	written := &fileRun[T]{file: file, codec: s.codec}
+
+	w := bufio.NewWriter(file)
+	err = mergeRuns(runs, s.compare, func(item T) error {
+		return s.codec.encode(w, item)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		written.close()
+		return nil, err
+	}
+	written.r = bufio.NewReader(file)
+	return written, nil
+}
+
+// Сортирует items и сбрасывает их во временный файл. Заполненный уровень сливается в одну порцию следующего
+func (s *externalSorter[T]) spill(items []T) error {
+	slices.SortFunc(items, s.compare)
+	run, err := s.writeRun([]sortedRun[T]{&sliceRun[T]{items}})
+	if err != nil {
+		return err
+	}
+	for level := 0; ; level++ {
+		if level == len(s.levels) {
+			s.levels = append(s.levels, nil)
+		}
+		s.levels[level] = append(s.levels[level], run)
+		if len(s.levels[level]) < mergeFanIn {
+			return nil
+		}
+
+		runs := make([]sortedRun[T], len(s.levels[level]))
+		for i, fr := range s.levels[level] {
+			runs[i] = fr
+		}
+		if run, err = s.writeRun(runs); err != nil {
+			return err
+		}
+		for _, fr := range s.levels[level] {
+			fr.close()
+		}
+		s.levels[level] = nil
+	}
+}
+
+// Сливает все сброшенные порции и оставшиеся в памяти items
+func (s *externalSorter[T]) merge(items []T, visit func(T) error) error {
+	slices.SortFunc(items, s.compare)
+	runs := []sortedRun[T]{&sliceRun[T]{items}}
+	for _, level := range s.levels {
+		for _, fr := range level {
+			runs = append(runs, fr)
+		}
+	}
+	return mergeRuns(runs, s.compare, visit)
+}
+
+func (s *externalSorter[T]) close() {
+	for _, level := range s.levels {
+		for _, fr := range level {
+			fr.close()
+		}
+	}
+	s.levels = nil
+}
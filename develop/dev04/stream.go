@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"io"
+	"slices"
+	"strings"
+)
+
+const defaultMemoryLimit = 64 << 20
+
+// Примерные накладные расходы на одно слово в памяти: заголовки строк и номер
+const entryOverhead = 48
+
+type StreamOptions struct {
+	// Примерный объём памяти под слова, после которого они сбрасываются во временный файл.
+	// Ноль - defaultMemoryLimit
+	MemoryLimit int64
+	// Каталог для временных файлов, пустой - os.TempDir()
+	TempDir string
+}
+
+type anagramEntry struct {
+	signature string
+	index     int
+	word      string
+}
+
+func compareEntries(a, b anagramEntry) int {
+	return cmp.Or(strings.Compare(a.signature, b.signature), cmp.Compare(a.index, b.index))
+}
+
+// Запись во временном файле: длина сигнатуры, сигнатура, номер слова, длина слова, слово
+var entryCodec = runCodec[anagramEntry]{
+	encode: func(w *bufio.Writer, entry anagramEntry) error {
+		var buf [binary.MaxVarintLen64]byte
+		w.Write(binary.AppendUvarint(buf[:0], uint64(len(entry.signature))))
+		w.WriteString(entry.signature)
+		w.Write(binary.AppendUvarint(buf[:0], uint64(entry.index)))
+		w.Write(binary.AppendUvarint(buf[:0], uint64(len(entry.word))))
+		_, err := w.WriteString(entry.word)
+		return err
+	},
+	decode: func(r *bufio.Reader) (anagramEntry, error) {
+		signature, err := readRunString(r)
+		if err != nil {
+			return anagramEntry{}, err
+		}
+		index, err := binary.ReadUvarint(r)
+		if err != nil {
+			return anagramEntry{}, io.ErrUnexpectedEOF
+		}
+		word, err := readRunString(r)
+		if err != nil {
+			return anagramEntry{}, io.ErrUnexpectedEOF
+		}
+		return anagramEntry{signature: signature, index: int(index), word: word}, nil
+	},
+}
+
+func readRunString(r *bufio.Reader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// Потоковая версия GroupByAnagrams для словарей, которые не помещаются в память: слова читаются из r
+// по одному на строку, при превышении лимита памяти отсортированная порция сбрасывается во временный файл,
+// а в конце все порции сливаются. Группы передаются в emit в порядке сигнатур, а не слов
+func StreamAnagramGroups(r io.Reader, opts StreamOptions, emit func(key string, words []string) error) error {
+	limit := opts.MemoryLimit
+	if limit == 0 {
+		limit = defaultMemoryLimit
+	}
+
+	sorter := &externalSorter[anagramEntry]{dir: opts.TempDir, pattern: "anagrams-*.run", compare: compareEntries, codec: entryCodec}
+	defer sorter.close()
+
+	entries := []anagramEntry{}
+	var used int64
+	scanner := bufio.NewScanner(r)
+	for index := 0; scanner.Scan(); index++ {
+		word := strings.TrimSpace(scanner.Text())
+		if word == "" {
+			continue
+		}
+		if !IsLower(word) {
+			word = strings.ToLower(word)
+		}
+
+		entry := anagramEntry{signature: GetCharCounts(word), index: index, word: word}
+		entries = append(entries, entry)
+		used += int64(len(entry.signature) + len(entry.word) + entryOverhead)
+		if used < limit {
+			continue
+		}
+
+		if err := sorter.spill(entries); err != nil {
+			return err
+		}
+		entries, used = entries[:0], 0
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	group := []anagramEntry{}
+	flush := func() error {
+		if len(group) <= 1 {
+			return nil
+		}
+		// Внутри сигнатуры слова идут в порядке словаря, так что первое из них - ключ
+		words := make([]string, len(group))
+		for i, entry := range group {
+			words[i] = entry.word
+		}
+		key := words[0]
+		slices.Sort(words)
+		return emit(key, words)
+	}
+	err := sorter.merge(entries, func(entry anagramEntry) error {
+		if len(group) != 0 && group[0].signature != entry.signature {
+			if err := flush(); err != nil {
+				return err
+			}
+			group = group[:0]
+		}
+		group = append(group, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Тот же результат, что у GroupByAnagrams, но слова читаются из r с ограничением памяти
+func GroupByAnagramsReader(r io.Reader, opts StreamOptions) (map[string][]string, error) {
+	result := map[string][]string{}
+	err := StreamAnagramGroups(r, opts, func(key string, words []string) error {
+		result[key] = words
+		return nil
+	})
+	return result, err
+}
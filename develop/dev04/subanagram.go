@@ -0,0 +1,269 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var ErrSearchTimeout = errors.New("Anagram search timed out")
+
+const (
+	defaultSearchLimit = 1000
+	defaultMaxWords    = 3
+)
+
+// Время проверяется раз в столько шагов поиска
+const timeoutCheckSteps = 1024
+
+type SearchOptions struct {
+	// Наибольшее число результатов, ноль - defaultSearchLimit
+	Limit int
+	// Время поиска, после которого возвращается то, что уже найдено, и ErrSearchTimeout. Ноль - без ограничения
+	Timeout time.Duration
+	// Наибольшее число слов в составной анаграмме, ноль - defaultMaxWords
+	MaxWords int
+	// Слова короче, в буквах после нормализации, не используются
+	MinLength int
+}
+
+// Узел префиксного дерева сигнатур: путь от корня - отсортированные буквы, words - слова ровно из этих букв
+type letterNode struct {
+	r         rune
+	signature string
+	length    int
+	children  []*letterNode
+	words     []string
+}
+
+func (n *letterNode) child(r rune) (int, bool) {
+	return slices.BinarySearchFunc(n.children, r, func(c *letterNode, r rune) int { return cmp.Compare(c.r, r) })
+}
+
+// Индекс мультимножеств букв словаря. Поиск спускается по дереву сигнатур только в буквы,
+// которые ещё остались в запросе, так что поддеревья с лишними буквами отсекаются целиком
+type LetterIndex struct {
+	root      letterNode
+	normalize NormalizeOptions
+}
+
+func NewLetterIndex(words []string, opts NormalizeOptions) *LetterIndex {
+	idx := &LetterIndex{normalize: opts}
+	for _, word := range words {
+		signature := GetCharCounts(opts.Normalize(word))
+		if signature == "" {
+			continue
+		}
+		node := &idx.root
+		for _, r := range signature {
+			i, ok := node.child(r)
+			if !ok {
+				child := &letterNode{r: r, length: node.length + 1, signature: node.signature + string(r)}
+				node.children = slices.Insert(node.children, i, child)
+			}
+			node = node.children[i]
+		}
+		if !slices.Contains(node.words, word) {
+			node.words = append(node.words, word)
+		}
+	}
+	idx.sortWords(&idx.root)
+	return idx
+}
+
+func (idx *LetterIndex) sortWords(node *letterNode) {
+	slices.Sort(node.words)
+	for _, c := range node.children {
+		idx.sortWords(c)
+	}
+}
+
+func (idx *LetterIndex) lookup(signature string) *letterNode {
+	node := &idx.root
+	for _, r := range signature {
+		i, ok := node.child(r)
+		if !ok {
+			return nil
+		}
+		node = node.children[i]
+	}
+	return node
+}
+
+// Состояние одного поиска: оставшиеся буквы запроса, лимиты и причина остановки
+type letterSearch struct {
+	remaining map[rune]int
+	left      int
+	limit     int
+	found     int
+	deadline  time.Time
+	steps     int
+	err       error
+}
+
+func newLetterSearch(normalized string, opts SearchOptions) *letterSearch {
+	s := &letterSearch{remaining: map[rune]int{}, limit: cmp.Or(opts.Limit, defaultSearchLimit)}
+	for _, r := range normalized {
+		s.remaining[r]++
+		s.left++
+	}
+	if opts.Timeout > 0 {
+		s.deadline = time.Now().Add(opts.Timeout)
+	}
+	return s
+}
+
+func (s *letterSearch) stopped() bool {
+	if s.err == nil && !s.deadline.IsZero() && s.steps%timeoutCheckSteps == 0 && time.Now().After(s.deadline) {
+		s.err = ErrSearchTimeout
+	}
+	s.steps++
+	return s.err != nil
+}
+
+// Ещё один результат, false - лимит исчерпан
+func (s *letterSearch) add() bool {
+	s.found++
+	return s.found < s.limit
+}
+
+// Сигнатура оставшихся букв
+func (s *letterSearch) signature() string {
+	runes := []rune{}
+	for r, count := range s.remaining {
+		for range count {
+			runes = append(runes, r)
+		}
+	}
+	slices.Sort(runes)
+	return string(runes)
+}
+
+// Обходит узлы со словами, которые можно составить из оставшихся букв, в порядке сигнатур начиная с from.
+// Пока visit работает, буквы узла вычтены из remaining. false из visit останавливает обход
+func (s *letterSearch) walk(node *letterNode, from string, visit func(*letterNode) bool) bool {
+	for _, c := range node.children {
+		// Все сигнатуры поддерева меньше from, если меньше её префикс той же длины
+		if s.remaining[c.r] == 0 || c.signature < from[:min(len(c.signature), len(from))] {
+			continue
+		}
+		if s.stopped() {
+			return false
+		}
+		s.remaining[c.r]--
+		s.left--
+		ok := (len(c.words) == 0 || c.signature < from || visit(c)) && s.walk(c, from, visit)
+		s.remaining[c.r]++
+		s.left++
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Слова словаря из части букв word, в том числе его анаграммы, кроме самого word.
+// Результат отсортирован по убыванию длины, затем по алфавиту
+func (idx *LetterIndex) SubAnagrams(word string, opts SearchOptions) ([]string, error) {
+	normalized := idx.normalize.Normalize(word)
+	s := newLetterSearch(normalized, opts)
+	result := []string{}
+	s.walk(&idx.root, "", func(node *letterNode) bool {
+		if node.length < opts.MinLength {
+			return true
+		}
+		for _, candidate := range node.words {
+			if s.left == 0 && idx.normalize.Normalize(candidate) == normalized {
+				continue
+			}
+			result = append(result, candidate)
+			if !s.add() {
+				return false
+			}
+		}
+		return true
+	})
+
+	slices.SortFunc(result, func(a, b string) int {
+		return cmp.Or(cmp.Compare(utf8.RuneCountInString(b), utf8.RuneCountInString(a)), strings.Compare(a, b))
+	})
+	return result, s.err
+}
+
+// Наборы не больше opts.MaxWords слов словаря, вместе составленные ровно из букв phrase.
+// Пробелы во фразе не учитываются всегда, остальное - по настройкам нормализации индекса.
+// Слова могут повторяться, а среди результатов есть и сама фраза, если она есть в словаре.
+// Внутри набора слова идут в порядке сигнатур, наборы отсортированы по числу слов, затем по алфавиту
+func (idx *LetterIndex) MultiWordAnagrams(phrase string, opts SearchOptions) ([][]string, error) {
+	phraseOpts := idx.normalize
+	phraseOpts.IgnoreSpaces = true
+	s := newLetterSearch(phraseOpts.Normalize(phrase), opts)
+	maxWords := cmp.Or(opts.MaxWords, defaultMaxWords)
+
+	result := [][]string{}
+	chosen := []*letterNode{}
+	words := []string{}
+	// Все наборы слов из выбранных сигнатур. Одинаковые сигнатуры подряд дают слова в неубывающем порядке,
+	// чтобы не повторять один набор в разном порядке
+	var expand func(i, first int) bool
+	expand = func(i, first int) bool {
+		if i == len(chosen) {
+			result = append(result, slices.Clone(words))
+			return s.add()
+		}
+		start := 0
+		if i > 0 && chosen[i] == chosen[i-1] {
+			start = first
+		}
+		for j := start; j < len(chosen[i].words); j++ {
+			words = append(words, chosen[i].words[j])
+			ok := expand(i+1, j)
+			words = words[:len(words)-1]
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+	choose := func(node *letterNode) bool {
+		chosen = append(chosen, node)
+		defer func() { chosen = chosen[:len(chosen)-1] }()
+		return expand(0, 0)
+	}
+
+	// Сигнатуры выбираются по неубыванию, так что каждый набор находится один раз
+	var search func(from string) bool
+	search = func(from string) bool {
+		// Последнее слово должно забрать все оставшиеся буквы: его не нужно искать обходом
+		if len(chosen) == maxWords-1 {
+			node := idx.lookup(s.signature())
+			if node == nil || len(node.words) == 0 || node.signature < from || node.length < opts.MinLength {
+				return true
+			}
+			return choose(node)
+		}
+		return s.walk(&idx.root, from, func(node *letterNode) bool {
+			if node.length < opts.MinLength {
+				return true
+			}
+			if s.left == 0 {
+				return choose(node)
+			}
+			chosen = append(chosen, node)
+			ok := search(node.signature)
+			chosen = chosen[:len(chosen)-1]
+			return ok
+		})
+	}
+	if s.left != 0 && maxWords > 0 {
+		search("")
+	}
+
+	slices.SortFunc(result, func(a, b []string) int {
+		return cmp.Or(cmp.Compare(len(a), len(b)), slices.Compare(a, b))
+	})
+	return result, s.err
+}
@@ -1,10 +1,11 @@
 package main
 
 import (
-	"fmt"
+	"os"
 	"slices"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 /*
@@ -26,16 +27,35 @@ import (
 Программа должна проходить все тесты. Код должен проходить проверки go vet и golint.
 */
 
+// Сигнатура слова - его руны по возрастанию, одинаковая у всех анаграмм
 func GetCharCounts(word string) string {
-	counts := map[rune]int{}
-	for _, char := range word {
-		if _, ok := counts[char]; ok {
-			counts[char]++
-		} else {
-			counts[char] = 1
+	return string(AppendSignature(nil, word))
+}
+
+// Дописывает сигнатуру слова в buf. Руны коротких слов сортируются на стеке,
+// так что с переиспользуемым buf память не выделяется
+func AppendSignature(buf []byte, word string) []byte {
+	var stack [32]rune
+	runes := stack[:0]
+	for _, r := range word {
+		runes = append(runes, r)
+	}
+
+	if len(runes) > len(stack) {
+		slices.Sort(runes)
+	} else {
+		// Вставками быстрее всего для коротких слов
+		for i := 1; i < len(runes); i++ {
+			for j := i; j > 0 && runes[j] < runes[j-1]; j-- {
+				runes[j], runes[j-1] = runes[j-1], runes[j]
+			}
 		}
 	}
-	return fmt.Sprintf("%v", counts)
+
+	for _, r := range runes {
+		buf = utf8.AppendRune(buf, r)
+	}
+	return buf
 }
 
 func IsLower(s string) bool {
@@ -48,29 +68,28 @@ func IsLower(s string) bool {
 }
 
 func GroupByAnagrams(words []string) map[string][]string {
-	anagrams := map[string][]string{}
+	// Группы хранятся отдельно от индекса, чтобы добавление слова в существующую группу
+	// обходилось поиском по string(buf) без выделения памяти под ключ
+	groupIndex := map[string]int{}
+	groups := [][]string{}
+	var buf []byte
 
 	for _, word := range words {
 		if !IsLower(word) {
 			word = strings.ToLower(word)
 		}
 
-		signature := GetCharCounts(word)
-		if slice, ok := anagrams[signature]; ok {
-			// Попытка не супер много раз выделять память
-			if cap(slice) < len(slice)+1 {
-				anagrams[signature] = append(slice, make([]string, len(slice))...)[:len(slice)+1]
-			} else {
-				anagrams[signature] = slice[:len(slice)+1]
-			}
-			anagrams[signature][len(slice)] = word
+		buf = AppendSignature(buf[:0], word)
+		if i, ok := groupIndex[string(buf)]; ok {
+			groups[i] = append(groups[i], word)
 		} else {
-			anagrams[signature] = []string{word}
+			groupIndex[string(buf)] = len(groups)
+			groups = append(groups, []string{word})
 		}
 	}
 
 	result := map[string][]string{}
-	for _, arr := range anagrams {
+	for _, arr := range groups {
 		if len(arr) <= 1 {
 			continue
 		}
@@ -83,4 +102,5 @@ func GroupByAnagrams(words []string) map[string][]string {
 }
 
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
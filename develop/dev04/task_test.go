@@ -1,8 +1,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type testCase[T any, Q any] struct {
@@ -58,3 +75,536 @@ func TestAnagramGrouping(t *testing.T) {
 	}
 
 }
+
+func TestNormalizeOptions(t *testing.T) {
+	testCases := []testCase[[]string, map[string][]string]{
+		{
+			input:  []string{"сёла", "леса"},
+			output: map[string][]string{},
+			hint:   "Yo isn't folded by default",
+		},
+		{
+			input:  []string{"Сёла", "леса", "Пятак", "пятак"},
+			output: map[string][]string{"Сёла": {"Сёла", "леса"}, "Пятак": {"Пятак", "пятак"}},
+			hint:   "Original forms are kept",
+		},
+		{
+			input:  []string{"столик", "сто лик", "ли-сток", "столик", "-"},
+			output: map[string][]string{"столик": {"ли-сток", "сто лик", "столик"}},
+			hint:   "Phrases and punctuation",
+		},
+		{
+			input:  []string{"Caf\u00e9", "face", "cafe\u0301"},
+			output: map[string][]string{"Caf\u00e9": {"Caf\u00e9", "cafe\u0301", "face"}},
+			hint:   "Diacritics, precomposed and combining",
+		},
+	}
+	opts := []NormalizeOptions{
+		{},
+		{FoldYo: true},
+		{IgnoreSpaces: true, IgnorePunctuation: true},
+		{StripDiacritics: true},
+	}
+
+	for i, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			testedOutput := GroupByAnagramsWithOptions(test.input, opts[i])
+
+			if !reflect.DeepEqual(testedOutput, test.output) {
+				t.Fatalf("Wrong output:\nexpected %v,\nrecieved %v\n", test.output, testedOutput)
+			}
+		})
+	}
+
+	t.Run("Short i and yo lose their marks", func(t *testing.T) {
+		opts := NormalizeOptions{StripDiacritics: true}
+		if normalized := opts.Normalize("Йогурт, ёж"); normalized != "иогурт, еж" {
+			t.Fatal("Wrong normalization: ", normalized)
+		}
+	})
+}
+
+func TestLetterIndex(t *testing.T) {
+	dictionary := []string{"кот", "ток", "кто", "сто", "лик", "кол", "кит", "ис", "о", "листок", "столик", "тесто", "сон"}
+	idx := NewLetterIndex(dictionary, NormalizeOptions{})
+
+	subCases := []testCase[SearchOptions, []string]{
+		{SearchOptions{MinLength: 2}, []string{"листок", "кит", "кол", "кот", "кто", "лик", "сто", "ток", "ис"}, "Words from a subset of letters"},
+		{SearchOptions{}, []string{"листок", "кит", "кол", "кот", "кто", "лик", "сто", "ток", "ис", "о"}, "Single letters"},
+		{SearchOptions{MinLength: 6}, []string{"листок"}, "Only anagrams"},
+	}
+	for _, test := range subCases {
+		t.Run(test.hint, func(t *testing.T) {
+			testedOutput, err := idx.SubAnagrams("Столик", test.input)
+			if err != nil || !reflect.DeepEqual(testedOutput, test.output) {
+				t.Fatalf("Wrong output:\nexpected %v,\nrecieved %v, %v\n", test.output, testedOutput, err)
+			}
+		})
+	}
+
+	multiCases := []testCase[SearchOptions, [][]string]{
+		{SearchOptions{MaxWords: 2, MinLength: 2}, [][]string{{"листок"}, {"столик"}, {"лик", "сто"}}, "Up to two words"},
+		{SearchOptions{MaxWords: 1}, [][]string{{"листок"}, {"столик"}}, "One word is an anagram"},
+		{SearchOptions{MaxWords: 3, Limit: 2}, [][]string{{"листок"}, {"лик", "сто"}}, "Result limit"},
+	}
+	for _, test := range multiCases {
+		t.Run(test.hint, func(t *testing.T) {
+			testedOutput, err := idx.MultiWordAnagrams("сто лик", test.input)
+			if err != nil || !reflect.DeepEqual(testedOutput, test.output) {
+				t.Fatalf("Wrong output:\nexpected %v,\nrecieved %v, %v\n", test.output, testedOutput, err)
+			}
+		})
+	}
+
+	t.Run("Repeated words", func(t *testing.T) {
+		expected := [][]string{{"кот", "кот"}, {"кот", "кто"}, {"кот", "ток"}, {"кто", "кто"}, {"кто", "ток"}, {"ток", "ток"}}
+		testedOutput, err := idx.MultiWordAnagrams("откток", SearchOptions{MaxWords: 2})
+		if err != nil || !reflect.DeepEqual(testedOutput, expected) {
+			t.Fatalf("Wrong output:\nexpected %v,\nrecieved %v, %v\n", expected, testedOutput, err)
+		}
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		idx := NewLetterIndex(generateDictionary(10000), NormalizeOptions{})
+		_, err := idx.MultiWordAnagrams("абвгдежзиклмнопрстуфхцчшщэюя", SearchOptions{MaxWords: 5, Timeout: time.Nanosecond})
+		if !errors.Is(err, ErrSearchTimeout) {
+			t.Fatal("Expected ErrSearchTimeout, got ", err)
+		}
+	})
+}
+
+// Словарь со множеством групп анаграмм: перестановки букв нескольких слов вперемешку с уникальными словами
+func generateDictionary(size int) []string {
+	rng := rand.New(rand.NewPCG(1, 2))
+	letters := []rune("абвгдежзиклмнопрстуфхцчшщэюя")
+	bases := []string{}
+	words := []string{}
+	for len(words) < size {
+		if len(bases) == 0 || rng.IntN(3) == 0 {
+			base := make([]rune, 4+rng.IntN(6))
+			for i := range base {
+				base[i] = letters[rng.IntN(len(letters))]
+			}
+			bases = append(bases, string(base))
+			words = append(words, string(base))
+			continue
+		}
+		word := []rune(bases[rng.IntN(len(bases))])
+		rng.Shuffle(len(word), func(i, j int) { word[i], word[j] = word[j], word[i] })
+		words = append(words, strings.ToUpper(string(word[:1]))+string(word[1:]))
+	}
+	return words
+}
+
+func TestStreamGrouping(t *testing.T) {
+	words := generateDictionary(5000)
+	expected := GroupByAnagrams(slices.Clone(words))
+	input := strings.Join(words, "\n") + "\n"
+
+	testCases := []testCase[StreamOptions, int]{
+		{StreamOptions{}, 0, "Everything fits in memory"},
+		{StreamOptions{MemoryLimit: 4096}, 0, "Many temporary files"},
+		{StreamOptions{MemoryLimit: 1}, 0, "One word per temporary file"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			dir := t.TempDir()
+			test.input.TempDir = dir
+			testedOutput, err := GroupByAnagramsReader(strings.NewReader(input), test.input)
+			if err != nil {
+				t.Fatal("Error while grouping: ", err)
+			}
+
+			if !reflect.DeepEqual(testedOutput, expected) {
+				t.Fatalf("Wrong output: expected %d groups, recieved %d", len(expected), len(testedOutput))
+			}
+
+			if files, _ := os.ReadDir(dir); len(files) != 0 {
+				t.Fatalf("Temporary files weren't removed: %d left", len(files))
+			}
+		})
+	}
+
+	t.Run("Simple example", func(t *testing.T) {
+		input := "пятак\nПЯтка\n\n  тяпка \nлисток\nслиток\nстолик\nовощи\n"
+		testedOutput, err := GroupByAnagramsReader(strings.NewReader(input), StreamOptions{MemoryLimit: 1, TempDir: t.TempDir()})
+		expected := map[string][]string{
+			"пятак":  {"пятак", "пятка", "тяпка"},
+			"листок": {"листок", "слиток", "столик"},
+		}
+		if err != nil || !reflect.DeepEqual(testedOutput, expected) {
+			t.Fatalf("Wrong output:\nexpected %v,\nrecieved %v, %v\n", expected, testedOutput, err)
+		}
+	})
+
+	t.Run("Error from emit stops the merge", func(t *testing.T) {
+		stop := errors.New("stop")
+		dir := t.TempDir()
+		calls := 0
+		err := StreamAnagramGroups(strings.NewReader(input), StreamOptions{MemoryLimit: 4096, TempDir: dir}, func(string, []string) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Fatal("Expected the emit error after one call, got ", err, calls)
+		}
+		if files, _ := os.ReadDir(dir); len(files) != 0 {
+			t.Fatalf("Temporary files weren't removed: %d left", len(files))
+		}
+	})
+}
+
+func TestExternalSorter(t *testing.T) {
+	codec := runCodec[uint64]{
+		encode: func(w *bufio.Writer, n uint64) error {
+			_, err := w.Write(binary.AppendUvarint(nil, n))
+			return err
+		},
+		decode: func(r *bufio.Reader) (uint64, error) {
+			return binary.ReadUvarint(r)
+		},
+	}
+	dir := t.TempDir()
+	sorter := &externalSorter[uint64]{dir: dir, pattern: "test-*.run", compare: cmp.Compare[uint64], codec: codec}
+	defer sorter.close()
+
+	const chunks = 1000
+	for i := range chunks {
+		if err := sorter.spill([]uint64{uint64(i * 7919 % chunks), uint64(chunks + i)}); err != nil {
+			t.Fatal("Error while spilling: ", err)
+		}
+	}
+	// 1000 = 3*16^2 + 14*16 + 8: на уровнях остаются цифры числа порций по основанию mergeFanIn
+	runs := []int{}
+	for _, level := range sorter.levels {
+		runs = append(runs, len(level))
+	}
+	if expected := []int{8, 14, 3}; !slices.Equal(runs, expected) {
+		t.Fatalf("Wrong runs per level:\nexpected %v,\nrecieved %v", expected, runs)
+	}
+
+	merged := []uint64{}
+	err := sorter.merge([]uint64{2 * chunks}, func(n uint64) error {
+		merged = append(merged, n)
+		return nil
+	})
+	if err != nil || len(merged) != 2*chunks+1 || !slices.IsSorted(merged) {
+		t.Fatal("Expected all the numbers in order, got ", len(merged), err)
+	}
+	sorter.close()
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("Temporary files weren't removed: %d left", len(files))
+	}
+}
+
+func TestSignature(t *testing.T) {
+	testCases := []testCase[[2]string, bool]{
+		{[2]string{"пятак", "тяпка"}, true, "Anagrams"},
+		{[2]string{"пятак", "пятаки"}, false, "Extra letter"},
+		{[2]string{"ааб", "абб"}, false, "Same letters, different counts"},
+		{[2]string{strings.Repeat("аб", 40), strings.Repeat("ба", 40)}, true, "Words longer than the stack buffer"},
+		{[2]string{"", ""}, true, "Empty words"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			equal := GetCharCounts(test.input[0]) == GetCharCounts(test.input[1])
+			if equal != test.output {
+				t.Fatalf("Wrong comparison of %q and %q:\nexpected %t,\nrecieved %t", test.input[0], test.input[1], test.output, equal)
+			}
+		})
+	}
+
+	t.Run("No allocations with a reused buffer", func(t *testing.T) {
+		buf := make([]byte, 0, 64)
+		allocs := testing.AllocsPerRun(100, func() {
+			buf = AppendSignature(buf[:0], "столик")
+		})
+		if allocs != 0 {
+			t.Fatal("Expected no allocations, got ", allocs)
+		}
+	})
+}
+
+func TestParallelGrouping(t *testing.T) {
+	words := generateDictionary(10000)
+	expected := GroupByAnagrams(words)
+	for _, workers := range []int{0, 1, 3, 16} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			if testedOutput := GroupByAnagramsParallel(words, workers); !reflect.DeepEqual(testedOutput, expected) {
+				t.Fatalf("Wrong output: expected %d groups, recieved %d", len(expected), len(testedOutput))
+			}
+		})
+	}
+
+	if testedOutput := GroupByAnagramsParallel(nil, 4); len(testedOutput) != 0 {
+		t.Fatal("Expected no groups for an empty dictionary, got ", testedOutput)
+	}
+}
+
+// Прежняя сигнатура, для сравнения в бенчмарках
+func legacyCharCounts(word string) string {
+	counts := map[rune]int{}
+	for _, char := range word {
+		counts[char]++
+	}
+	return fmt.Sprintf("%v", counts)
+}
+
+var benchmarkDictionary = sync.OnceValue(func() []string {
+	return generateDictionary(1_000_000)
+})
+
+func BenchmarkSignature(b *testing.B) {
+	words := benchmarkDictionary()
+
+	b.Run("Legacy map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			legacyCharCounts(words[i%len(words)])
+		}
+	})
+
+	b.Run("Sorted runes", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf = AppendSignature(buf[:0], words[i%len(words)])
+		}
+	})
+}
+
+// Группировка словаря из миллиона слов целиком
+func BenchmarkGroupByAnagrams(b *testing.B) {
+	words := benchmarkDictionary()
+
+	b.Run("Sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			GroupByAnagrams(words)
+		}
+	})
+
+	b.Run("Parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			GroupByAnagramsParallel(words, 0)
+		}
+	})
+}
+
+func TestIndex(t *testing.T) {
+	words := []string{"пятак", "ПЯтка", "тяпка", "листок", "слиток", "столик", "овощи", "пятак"}
+	idx := NewIndex(words)
+
+	anagramCases := []testCase[string, []string]{
+		{"пятак", []string{"пятка", "тяпка"}, "Dictionary word"},
+		{"Тяпка", []string{"пятак", "пятка"}, "Uppercase query"},
+		{"щиово", []string{"овощи"}, "Word without anagrams in the dictionary"},
+		{"кот", []string{}, "Unknown letters"},
+	}
+	for _, test := range anagramCases {
+		t.Run(test.hint, func(t *testing.T) {
+			if testedOutput := idx.Anagrams(test.input); !reflect.DeepEqual(testedOutput, test.output) {
+				t.Fatalf("Wrong output:\nexpected %v,\nrecieved %v\n", test.output, testedOutput)
+			}
+		})
+	}
+
+	t.Run("Is an anagram", func(t *testing.T) {
+		if !IsAnagram("пятак", "ТЯПКА") || IsAnagram("пятак", "пятак") || IsAnagram("пятак", "пятаки") {
+			t.Fatal("Wrong anagram check")
+		}
+	})
+
+	t.Run("Save and load", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := idx.Save(&b); err != nil {
+			t.Fatal("Error while saving: ", err)
+		}
+		loaded, err := LoadIndex(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal("Error while loading: ", err)
+		}
+		if !reflect.DeepEqual(loaded.groups, idx.groups) {
+			t.Fatalf("Wrong index:\nexpected %v,\nrecieved %v\n", idx.groups, loaded.groups)
+		}
+
+		if _, err := LoadIndex(bytes.NewReader(b.Bytes()[:b.Len()-3])); !errors.Is(err, ErrBadIndex) {
+			t.Fatal("Expected ErrBadIndex for a truncated index, got ", err)
+		}
+		if _, err := LoadIndex(strings.NewReader("пятак\nпятка\n")); !errors.Is(err, ErrBadIndex) {
+			t.Fatal("Expected ErrBadIndex for a dictionary, got ", err)
+		}
+
+		// Длина слова в 4 ГиБ в файле из нескольких байт не должна приводить к выделению памяти под неё
+		huge := binary.AppendUvarint([]byte(indexMagic+"\x01\x01\x00"), 1<<32)
+		if _, err := LoadIndex(bytes.NewReader(huge)); !errors.Is(err, ErrBadIndex) {
+			t.Fatal("Expected ErrBadIndex for a huge word length, got ", err)
+		}
+
+		var again bytes.Buffer
+		if err := NewIndex(words).Save(&again); err != nil || !bytes.Equal(again.Bytes(), b.Bytes()) {
+			t.Fatal("Saving the same index twice gave different files: ", err)
+		}
+	})
+
+	t.Run("Groups", func(t *testing.T) {
+		expected := map[string][]string{
+			"пятак":  {"пятак", "пятка", "тяпка"},
+			"листок": {"листок", "слиток", "столик"},
+		}
+		if testedOutput := idx.Groups(); !reflect.DeepEqual(testedOutput, expected) {
+			t.Fatalf("Wrong output:\nexpected %v,\nrecieved %v\n", expected, testedOutput)
+		}
+
+		// Ключ - первое встретившееся слово, как в GroupByAnagrams, и после загрузки тоже
+		words := []string{"тяпка", "пятак", "столик", "Пятка", "листок"}
+		var b bytes.Buffer
+		if err := NewIndex(words).Save(&b); err != nil {
+			t.Fatal("Error while saving: ", err)
+		}
+		loaded, err := LoadIndex(&b)
+		if err != nil {
+			t.Fatal("Error while loading: ", err)
+		}
+		expected = GroupByAnagrams(words)
+		if testedOutput := loaded.Groups(); !reflect.DeepEqual(testedOutput, expected) {
+			t.Fatalf("Wrong output:\nexpected %v,\nrecieved %v\n", expected, testedOutput)
+		}
+	})
+
+	t.Run("HTTP", func(t *testing.T) {
+		server := httptest.NewServer(NewIndexHandler(idx))
+		defer server.Close()
+
+		testCases := []testCase[string, string]{
+			{"/anagrams?word=" + url.QueryEscape("пятак"), `{"anagrams":["пятка","тяпка"],"word":"пятак"}`, "Anagrams"},
+			{"/is-anagram?a=" + url.QueryEscape("листок") + "&b=" + url.QueryEscape("столик"), `{"a":"листок","anagram":true,"b":"столик"}`, "Is an anagram"},
+			{"/anagrams", "Missing the word parameter", "Missing parameter"},
+		}
+		for _, test := range testCases {
+			resp, err := http.Get(server.URL + test.input)
+			if err != nil {
+				t.Fatal("Error while querying: ", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if strings.TrimSpace(string(body)) != test.output {
+				t.Fatalf("%s: wrong response:\nexpected %s,\nrecieved %s", test.hint, test.output, body)
+			}
+		}
+	})
+}
+
+func TestIndexCLI(t *testing.T) {
+	dir := t.TempDir()
+	dictionary := filepath.Join(dir, "dict.txt")
+	indexFile := filepath.Join(dir, "dict.idx")
+	if err := os.WriteFile(dictionary, []byte("пятак\nпятка\nтяпка\n\nлисток\nслиток\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr strings.Builder
+	if code := run([]string{"index", "-o", indexFile, dictionary}, nil, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Index failed with code %d: %s", code, stderr.String())
+	}
+
+	stdout.Reset()
+	if code := run([]string{"query", "-index", indexFile, "тяпка", "столик"}, nil, &stdout, &stderr); code != exitOK {
+		t.Fatalf("Query failed with code %d: %s", code, stderr.String())
+	}
+	expected := "тяпка: пятак пятка\nстолик: листок слиток\n"
+	if stdout.String() != expected {
+		t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q", expected, stdout.String())
+	}
+
+	if code := run([]string{"query", "-index", dictionary, "тяпка"}, nil, &stdout, &stderr); code != exitFailed {
+		t.Fatal("Expected a failure for a file that isn't an index, got ", code)
+	}
+	if code := run([]string{"unknown"}, nil, &stdout, &stderr); code != exitUsage {
+		t.Fatal("Expected a usage error, got ", code)
+	}
+}
+
+func TestGroupCLI(t *testing.T) {
+	input := "пятак\nПятка\nтяпка\nлисток\nслиток\nстолик\nкот\nток\nовощи\n"
+	testCases := []testCase[[]string, string]{
+		{[]string{"group"}, "кот: кот ток\nлисток: листок слиток столик\nпятак: пятак пятка тяпка\n", "Text sorted by key"},
+		{[]string{"group", "-sort", "size", "-min-size", "3"}, "листок: листок слиток столик\nпятак: пятак пятка тяпка\n", "Sorted by size with a minimum size"},
+		{[]string{"group", "-format", "csv", "-min-size", "3"}, "key,size,words\nлисток,3,листок слиток столик\nпятак,3,пятак пятка тяпка\n", "CSV"},
+		{[]string{"group", "-format", "json", "-sort", "size", "-min-size", "3"}, `[
+  {
+    "key": "листок",
+    "words": [
+      "листок",
+      "слиток",
+      "столик"
+    ]
+  },
+  {
+    "key": "пятак",
+    "words": [
+      "пятак",
+      "пятка",
+      "тяпка"
+    ]
+  }
+]
+`, "JSON"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.hint, func(t *testing.T) {
+			var stdout, stderr strings.Builder
+			if code := run(test.input, strings.NewReader(input), &stdout, &stderr); code != exitOK {
+				t.Fatalf("Grouping failed with code %d: %s", code, stderr.String())
+			}
+			if stdout.String() != test.output {
+				t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q", test.output, stdout.String())
+			}
+		})
+	}
+
+	t.Run("Duplicates", func(t *testing.T) {
+		var stdout, stderr strings.Builder
+		if code := run([]string{"group", "-stats"}, strings.NewReader(input+"Кот\nкот\nпятак\nдом\nДом\n"), &stdout, &stderr); code != exitOK {
+			t.Fatalf("Grouping failed with code %d: %s", code, stderr.String())
+		}
+		expected := "кот: кот ток\nлисток: листок слиток столик\nпятак: пятак пятка тяпка\n"
+		if stdout.String() != expected {
+			t.Fatalf("Wrong output:\nexpected %q,\nrecieved %q", expected, stdout.String())
+		}
+		expected = "Групп анаграмм: 3\nСамая большая группа: 3 (листок слиток столик)\nСлов без анаграмм: 2\n"
+		if stderr.String() != expected {
+			t.Fatalf("Wrong statistics:\nexpected %q,\nrecieved %q", expected, stderr.String())
+		}
+	})
+
+	t.Run("Statistics of printed groups", func(t *testing.T) {
+		var stdout, stderr strings.Builder
+		if code := run([]string{"group", "-stats", "-sort", "size", "-min-size", "3"}, strings.NewReader(input), &stdout, &stderr); code != exitOK {
+			t.Fatalf("Grouping failed with code %d: %s", code, stderr.String())
+		}
+		expected := "Групп анаграмм: 2\nСамая большая группа: 3 (листок слиток столик)\nСлов без анаграмм: 1\n"
+		if stderr.String() != expected {
+			t.Fatalf("Wrong statistics:\nexpected %q,\nrecieved %q", expected, stderr.String())
+		}
+
+		stderr.Reset()
+		if code := run([]string{"group", "-stats", "-min-size", "10"}, strings.NewReader(input), &stdout, &stderr); code != exitOK {
+			t.Fatalf("Grouping failed with code %d: %s", code, stderr.String())
+		}
+		expected = "Групп анаграмм: 0\nСамая большая группа: нет\nСлов без анаграмм: 1\n"
+		if stderr.String() != expected {
+			t.Fatalf("Wrong statistics:\nexpected %q,\nrecieved %q", expected, stderr.String())
+		}
+	})
+
+	var stderr strings.Builder
+	if code := run([]string{"group", "-min-size", "-1"}, strings.NewReader(input), io.Discard, &stderr); code != exitUsage {
+		t.Fatal("Expected a usage error for a negative minimum size, got ", code)
+	}
+	if code := run([]string{"group", "-format", "xml"}, strings.NewReader(input), io.Discard, &stderr); code != exitUsage {
+		t.Fatal("Expected a usage error for an unknown format, got ", code)
+	}
+}